@@ -0,0 +1,80 @@
+package portier
+
+import (
+	"sync"
+	"time"
+)
+
+// circuitBreaker tracks consecutive fetch failures for a broker. After
+// threshold failures, the circuit opens, and fetches fail immediately for the
+// cooldown period. After that, a single fetch is allowed through as a probe,
+// which either closes the circuit or opens it again.
+//
+// A nil *circuitBreaker is disabled, and allows all fetches.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	lock      sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow returns an error if the circuit is open. Otherwise, the caller must
+// report the result of its fetch using record, or call release if the fetch
+// was aborted without a result.
+func (breaker *circuitBreaker) allow(broker string, now time.Time) error {
+	if breaker == nil {
+		return nil
+	}
+
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+
+	if breaker.failures < breaker.threshold {
+		return nil
+	}
+	if now.Before(breaker.openUntil) || breaker.probing {
+		return newError(ErrBrokerUnavailable, "broker %s unavailable after %d failed requests", broker, breaker.failures)
+	}
+	breaker.probing = true
+	return nil
+}
+
+// record updates the circuit with the result of a fetch.
+func (breaker *circuitBreaker) record(ok bool, now time.Time) {
+	if breaker == nil {
+		return
+	}
+
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+
+	breaker.probing = false
+	if ok {
+		breaker.failures = 0
+		return
+	}
+	breaker.failures++
+	if breaker.failures >= breaker.threshold {
+		breaker.openUntil = now.Add(breaker.cooldown)
+	}
+}
+
+// release ends a probe allowed by allow without counting a result, for a
+// fetch that was aborted by the caller. The next fetch becomes the probe.
+func (breaker *circuitBreaker) release() {
+	if breaker == nil {
+		return
+	}
+
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+
+	breaker.probing = false
+}
@@ -0,0 +1,74 @@
+package portier
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	type step struct {
+		advance time.Duration
+		action  string // result after allow: "ok", "fail", "release" or none for "probe"; or "reject"
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"below threshold", []step{
+			{0, "fail"}, {0, "ok"}, {0, "fail"}, {0, "fail"},
+		}},
+		{"opens at threshold", []step{
+			{0, "fail"}, {0, "fail"}, {0, "fail"}, {0, "reject"}, {59 * time.Second, "reject"},
+		}},
+		{"single probe after cooldown", []step{
+			{0, "fail"}, {0, "fail"}, {0, "fail"}, {time.Minute, "probe"}, {0, "reject"},
+		}},
+		{"failed probe reopens", []step{
+			{0, "fail"}, {0, "fail"}, {0, "fail"}, {time.Minute, "fail"}, {0, "reject"}, {59 * time.Second, "reject"}, {time.Second, "ok"},
+		}},
+		{"successful probe closes", []step{
+			{0, "fail"}, {0, "fail"}, {0, "fail"}, {time.Minute, "ok"}, {0, "fail"}, {0, "fail"}, {0, "ok"},
+		}},
+		{"released probe", []step{
+			{0, "fail"}, {0, "fail"}, {0, "fail"}, {time.Minute, "release"}, {0, "fail"}, {0, "reject"},
+		}},
+	}
+
+	for _, test := range tests {
+		breaker := newCircuitBreaker(3, time.Minute)
+		now := time.Now()
+		for i, step := range test.steps {
+			now = now.Add(step.advance)
+			err := breaker.allow("https://broker.test", now)
+			if step.action == "reject" {
+				if !errors.Is(err, ErrBrokerUnavailable) {
+					t.Errorf("%s: step %d: got %v, want ErrBrokerUnavailable", test.name, i, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s: step %d: %s", test.name, i, err)
+			}
+			switch step.action {
+			case "ok":
+				breaker.record(true, now)
+			case "fail":
+				breaker.record(false, now)
+			case "release":
+				breaker.release()
+			}
+		}
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	var breaker *circuitBreaker
+	for i := 0; i < 10; i++ {
+		if err := breaker.allow("https://broker.test", time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		breaker.record(false, time.Now())
+	}
+	breaker.release()
+}
@@ -0,0 +1,170 @@
+package portier
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default bounds on the cache lifespan of a successful response, regardless
+// of the Cache-Control header. The lower bound prevents fetching documents
+// from the broker on every login, the upper bound ensures key rotation is
+// noticed. See WithMinCacheAge and WithMaxCacheAge.
+const (
+	DefaultMinCacheAge = time.Duration(1) * time.Minute
+	DefaultMaxCacheAge = time.Duration(24) * time.Hour
+)
+
+// maxDeltaSeconds is the largest delta-seconds value, as RFC 9111 suggests.
+const maxDeltaSeconds = 1<<31 - 1
+
+// maxRetryAfter bounds how long errors are cached based on Retry-After, so a
+// misconfigured broker can't disable logins for long.
+const maxRetryAfter = time.Duration(5) * time.Minute
+
+// cacheControl contains the parsed directives of a Cache-Control header, and
+// the Age header. Only the directives relevant to a client cache are included.
+type cacheControl struct {
+	age            time.Duration // Age, or zero if absent
+	maxAge         time.Duration // max-age, or -1 if absent
+	sMaxAge        time.Duration // s-maxage, or -1 if absent
+	noStore        bool
+	noCache        bool
+	mustRevalidate bool // must-revalidate or proxy-revalidate
+}
+
+// parseCacheControl parses the Cache-Control and Age headers as described in
+// RFC 9111. Unknown and malformed directives are ignored. If a directive
+// occurs more than once, the first occurrence is used.
+func parseCacheControl(header http.Header) cacheControl {
+	cc := cacheControl{maxAge: -1, sMaxAge: -1}
+	if age := parseDeltaSeconds(strings.TrimSpace(header.Get("Age"))); age > 0 {
+		cc.age = age
+	}
+	seen := make(map[string]bool)
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range splitDirectives(value) {
+			name, arg, _ := strings.Cut(directive, "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			arg = strings.TrimSpace(arg)
+			if unquoted, err := strconv.Unquote(arg); err == nil && strings.HasPrefix(arg, `"`) {
+				arg = unquoted
+			}
+			if name == "" || seen[name] {
+				continue
+			}
+			seen[name] = true
+
+			switch name {
+			case "max-age":
+				cc.maxAge = parseDeltaSeconds(arg)
+			case "s-maxage":
+				cc.sMaxAge = parseDeltaSeconds(arg)
+			case "no-store":
+				cc.noStore = true
+			case "no-cache":
+				cc.noCache = true
+			case "must-revalidate", "proxy-revalidate":
+				cc.mustRevalidate = true
+			}
+		}
+	}
+	return cc
+}
+
+// splitDirectives splits a Cache-Control value on commas outside of quoted
+// strings.
+func splitDirectives(value string) []string {
+	var directives []string
+	start := 0
+	quoted := false
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			if quoted {
+				i++
+			}
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				directives = append(directives, value[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(directives, value[start:])
+}
+
+// parseDeltaSeconds parses a delta-seconds argument, returning -1 if invalid.
+// Values too large to represent are capped, as RFC 9111 requires.
+func parseDeltaSeconds(arg string) time.Duration {
+	seconds, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil {
+		if numErr, ok := err.(*strconv.NumError); ok && numErr.Err == strconv.ErrRange {
+			seconds = maxDeltaSeconds
+		} else {
+			return -1
+		}
+	}
+	if seconds > maxDeltaSeconds {
+		seconds = maxDeltaSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// lifespan returns the cache lifespan for a successful response. The Store is
+// usually shared by all users of an application, so s-maxage takes precedence
+// over max-age. Responses that may not be stored or reused without
+// revalidation get the minimum lifespan.
+//
+// The Age is subtracted, because a response from an intermediate cache, such
+// as a CDN, has already been cached for some of its lifetime.
+func (cc cacheControl) lifespan(minAge, maxAge time.Duration) time.Duration {
+	lifespan := defaultMaxAge
+	switch {
+	case cc.noStore, cc.noCache:
+		lifespan = minAge
+	case cc.sMaxAge >= 0:
+		lifespan = cc.sMaxAge
+	case cc.maxAge >= 0:
+		lifespan = cc.maxAge
+	}
+
+	lifespan -= cc.age
+	if lifespan < minAge {
+		lifespan = minAge
+	}
+	if lifespan > maxAge {
+		lifespan = maxAge
+	}
+	return lifespan
+}
+
+// parseRetryAfter parses the Retry-After header, which is either
+// delta-seconds or an HTTP-date. It returns zero if absent or invalid, and is
+// bounded by maxRetryAfter.
+func parseRetryAfter(header http.Header, now time.Time) time.Duration {
+	value := strings.TrimSpace(header.Get("Retry-After"))
+	if value == "" {
+		return 0
+	}
+
+	retryAfter := parseDeltaSeconds(value)
+	if retryAfter < 0 {
+		date, err := http.ParseTime(value)
+		if err != nil {
+			return 0
+		}
+		retryAfter = date.Sub(now)
+	}
+
+	if retryAfter < 0 {
+		return 0
+	}
+	if retryAfter > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return retryAfter
+}
@@ -0,0 +1,57 @@
+package portier
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCacheControlLifespan(t *testing.T) {
+	tests := []struct {
+		cacheControl string
+		age          string
+		want         time.Duration
+	}{
+		{"", "", defaultMaxAge},
+		{"max-age=3600", "", time.Hour},
+		{"max-age=3600", "600", 50 * time.Minute},
+		{"public, s-maxage=7200, max-age=3600", "", 2 * time.Hour},
+		{"MAX-AGE=3600", "", time.Hour},
+		{"max-age=\"3600\"", "", time.Hour},
+		{"max-age=3600, max-age=10", "", time.Hour},
+		{"no-cache, max-age=3600", "", DefaultMinCacheAge},
+		{"no-store", "", DefaultMinCacheAge},
+		{"max-age=10", "", DefaultMinCacheAge},
+		{"max-age=3600", "7200", DefaultMinCacheAge},
+		{"max-age=99999999999", "", DefaultMaxCacheAge},
+		{"max-age=bogus", "", defaultMaxAge},
+		{"private=\"max-age=3600, no-store\"", "", defaultMaxAge},
+	}
+	for _, test := range tests {
+		header := make(http.Header)
+		if test.cacheControl != "" {
+			header.Set("Cache-Control", test.cacheControl)
+		}
+		if test.age != "" {
+			header.Set("Age", test.age)
+		}
+		got := parseCacheControl(header).lifespan(DefaultMinCacheAge, DefaultMaxCacheAge)
+		if got != test.want {
+			t.Errorf("Cache-Control %q, Age %q: got %s, want %s", test.cacheControl, test.age, got, test.want)
+		}
+	}
+}
+
+func TestCacheControlMustRevalidate(t *testing.T) {
+	for value, want := range map[string]bool{
+		"max-age=60":                   false,
+		"max-age=60, must-revalidate":  true,
+		"proxy-revalidate":             true,
+		"no-cache=\"must-revalidate\"": false,
+	} {
+		header := http.Header{"Cache-Control": {value}}
+		if got := parseCacheControl(header).mustRevalidate; got != want {
+			t.Errorf("Cache-Control %q: got must-revalidate %v, want %v", value, got, want)
+		}
+	}
+}
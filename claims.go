@@ -0,0 +1,91 @@
+package portier
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+// maxLeeway returns the largest of the per-claim leeways. This is given to
+// jwt.Parse, and stricter leeways are then applied by checkClaims.
+func (client *client) maxLeeway() time.Duration {
+	leeway := client.expLeeway
+	if client.nbfLeeway > leeway {
+		leeway = client.nbfLeeway
+	}
+	if client.iatLeeway > leeway {
+		leeway = client.iatLeeway
+	}
+	return leeway
+}
+
+// checkClaims applies the claim policies from Config to a token, after
+// jwt.Parse has verified the signature and standard claims.
+func (client *client) checkClaims(token jwt.Token) error {
+	now := client.clock()
+	if exp := token.Expiration(); !exp.IsZero() && !now.Before(exp.Add(client.expLeeway)) {
+		return newError(ErrTokenExpired, "token expired at %s", exp)
+	}
+	if nbf := token.NotBefore(); !nbf.IsZero() && now.Add(client.nbfLeeway).Before(nbf) {
+		return newError(ErrTokenNotYetValid, "token not valid before %s", nbf)
+	}
+	if iat := token.IssuedAt(); !iat.IsZero() && now.Add(client.iatLeeway).Before(iat) {
+		return newError(ErrTokenNotYetValid, "token issued in the future at %s", iat)
+	}
+
+	matched := false
+	for _, audience := range token.Audience() {
+		if client.clientIDs[audience] {
+			matched = true
+		} else if client.strictAudience {
+			return newError(ErrInvalidAudience, "token has additional audience: %s", audience)
+		}
+	}
+	if !matched {
+		return newError(ErrInvalidAudience, "token not issued for this client")
+	}
+
+	if client.checkEmailVerified || client.requireEmailVerified {
+		verifiedVal, ok := token.Get("email_verified")
+		if !ok {
+			if client.requireEmailVerified {
+				return newError(ErrInvalidToken, "email_verified claim missing")
+			}
+		} else if verified, _ := verifiedVal.(bool); !verified {
+			return newError(ErrInvalidToken, "email address not verified")
+		}
+	}
+
+	for name, want := range client.requiredClaims {
+		value, ok := token.Get(name)
+		if !ok {
+			return newError(ErrInvalidToken, "required claim missing: %s", name)
+		}
+		if want != nil && !reflect.DeepEqual(value, want) {
+			return newError(ErrInvalidToken, "claim has unexpected value: %s", name)
+		}
+	}
+	for _, name := range client.forbiddenClaims {
+		if _, ok := token.Get(name); ok {
+			return newError(ErrInvalidToken, "forbidden claim present: %s", name)
+		}
+	}
+
+	for _, validator := range client.validators {
+		if err := validator(token); err != nil {
+			return newError(ErrInvalidToken, "token rejected: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
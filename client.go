@@ -1,12 +1,19 @@
 package portier
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
+	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
 	"github.com/lestrrat-go/jwx/v2/jwt"
 	"github.com/lestrrat-go/option"
 )
@@ -19,10 +26,13 @@ const (
 
 // Defaults for Config fields.
 const (
-	DefaultBroker       = "https://broker.portier.io"
-	DefaultResponseMode = ResponseModeFormPost
-	DefaultLeeway       = time.Duration(3) * time.Minute
-	DefaultHTTPTimeout  = time.Duration(10) * time.Second
+	DefaultBroker          = "https://broker.portier.io"
+	DefaultResponseMode    = ResponseModeFormPost
+	DefaultLeeway          = time.Duration(3) * time.Minute
+	DefaultHTTPTimeout     = time.Duration(10) * time.Second
+	DefaultMaxTokenSize    = 8 * 1024
+	DefaultScope           = "openid email"
+	DefaultBreakerCooldown = time.Duration(30) * time.Second
 )
 
 const discoveryPath = "/.well-known/openid-configuration"
@@ -38,11 +48,201 @@ type Config struct {
 	RedirectURI  string        // Absolute URL to an app route that calls Verify
 	ResponseMode string        // How to call RedirectURI: form_post or fragment
 	Leeway       time.Duration // Time offset to allow when validating JWT claims
+	MaxTokenSize int           // Maximum size in bytes of tokens given to Verify
+
+	// FallbackBrokers are origins of standby brokers, tried in order when the
+	// discovery document of Broker can't be fetched. StartAuth uses the first
+	// reachable broker, and Verify accepts tokens issued by any of them.
+	FallbackBrokers []string
+
+	// Scopes are the scopes requested from the broker, which determine the
+	// claims in the token. The default is DefaultScope. Portier brokers
+	// require at least "openid" and "email".
+	Scopes []string
+
+	// ExpLeeway, NbfLeeway and IatLeeway override Leeway for the exp, nbf and
+	// iat claims respectively, for example to allow generous clock drift on iat
+	// while keeping expiry strict. If zero, Leeway is used.
+	ExpLeeway time.Duration
+	NbfLeeway time.Duration
+	IatLeeway time.Duration
+
+	// SessionTTL sets how long login sessions started by StartAuth remain
+	// valid, for example longer for brokers that send email links. It requires
+	// a Store that implements SessionTTLStore, like the default in-memory
+	// store. The default is zero, meaning the Store decides.
+	SessionTTL time.Duration
+
+	// RetryWindow allows verifying the same token again for a short time after
+	// it was first verified, returning the original result. This helps when
+	// browsers submit the callback twice, for example on refresh. Results are
+	// remembered in memory by the Client, so this does not work across
+	// processes. The default is zero, meaning a second attempt fails with
+	// ErrInvalidSession.
+	RetryWindow time.Duration
+
+	// KeyCacheTTL enables a cache of the parsed key set of each broker in the
+	// Client, so verifying a token doesn't need to go through the Store. If a
+	// token is signed with a key that is not in the cached set, the key set is
+	// fetched from the Store again, so key rotation is still noticed. However,
+	// a key the broker has removed stays trusted for up to KeyCacheTTL, in
+	// addition to the cache lifespan of the Store. The default of zero
+	// disables the cache.
+	KeyCacheTTL time.Duration
+
+	// BreakerThreshold enables a circuit breaker per broker. After this many
+	// consecutive failures to fetch the discovery document or keys, requests
+	// to the broker fail immediately with ErrBrokerUnavailable for
+	// BreakerCooldown, instead of each waiting for the HTTP timeout. StartAuth
+	// then also moves on to FallbackBrokers immediately. After the cooldown, a
+	// single request is let through to test the broker. The default is zero,
+	// meaning disabled.
+	BreakerThreshold int
+
+	// BreakerCooldown is how long the circuit breaker stays open. The default
+	// is DefaultBreakerCooldown.
+	BreakerCooldown time.Duration
+
+	// CheckTokenID rejects tokens with a jti claim that was seen before, until
+	// the token expires. This protects against replay of leaked tokens beyond
+	// the nonce check. It requires a Store that implements TokenIDStore, like
+	// the default in-memory store. Tokens without a jti claim are accepted.
+	CheckTokenID bool
+
+	// Clock returns the current time, for validating JWT claims and for the
+	// default in-memory store. The default is time.Now.
+	Clock func() time.Time
+
+	// AllowedAlgorithms restricts the signing algorithms accepted in tokens, for
+	// example to only jwa.RS256. Tokens signed with a different algorithm are
+	// rejected with ErrInvalidSignature, even if the broker publishes a matching
+	// key. The default is to accept any algorithm supported by the key set,
+	// including RSA and Ed25519 (jwa.EdDSA) keys.
+	AllowedAlgorithms []jwa.SignatureAlgorithm
+
+	// PinnedKeys restricts verification to broker keys with the given RFC 7638
+	// SHA-256 thumbprints, as returned by KeyThumbprint. Keys in the broker key
+	// set that are not pinned are ignored, so a compromised key set endpoint
+	// can't introduce new keys. Key rotation by the broker then requires a
+	// configuration change. The default is to trust all keys in the key set.
+	PinnedKeys []string
+
+	// AdditionalAudiences lists origins the application is also served on, for
+	// example a www subdomain or vanity domains. Tokens issued for any of these
+	// client IDs are accepted. Use WithRedirectURI in StartAuth to select one,
+	// otherwise the origin of RedirectURI is used.
+	AdditionalAudiences []string
+
+	// StrictAudience rejects tokens with an aud claim that lists audiences other
+	// than this client. By default, tokens are accepted if this client is one
+	// of possibly multiple audiences.
+	StrictAudience bool
+
+	// CheckEmailVerified rejects tokens with an email_verified claim that is
+	// not true. Portier brokers don't set this claim, because every address
+	// they assert is verified, but other OpenID Connect providers may.
+	CheckEmailVerified bool
+
+	// RequireEmailVerified is like CheckEmailVerified, but also rejects tokens
+	// without an email_verified claim.
+	RequireEmailVerified bool
+
+	// RequiredClaims lists claims that must be present in tokens. If the value
+	// is not nil, the claim must also have that value, as decoded from JSON: a
+	// string, float64, bool, or a []interface{} or map[string]interface{}.
+	RequiredClaims map[string]interface{}
+
+	// ForbiddenClaims lists claims that must not be present in tokens.
+	ForbiddenClaims []string
+
+	// Validators are called with each token after the built-in checks pass, to
+	// enforce application policies such as a maximum token age. If one returns
+	// an error, Verify fails with an error wrapping it, that also matches
+	// ErrInvalidToken.
+	Validators []func(token jwt.Token) error
+
+	// AllowedDomains restricts logins to email addresses in the listed domains.
+	// Domains are compared case-insensitively, and subdomains must be listed
+	// separately. Both StartAuth and Verify reject other addresses with an
+	// error matching ErrEmailNotAllowed.
+	AllowedDomains []string
+
+	// DeniedDomains is like AllowedDomains, but rejects the listed domains.
+	DeniedDomains []string
+
+	// EmailPolicy is called by StartAuth and Verify with the email address, for
+	// policies not covered by AllowedDomains and DeniedDomains. If it returns
+	// an error, the address is rejected with an error wrapping it, that also
+	// matches ErrEmailNotAllowed.
+	EmailPolicy func(email string) error
+
+	// RateLimiter is consulted by StartAuth before starting a session. If it
+	// refuses, StartAuth returns an error matching ErrRateLimited.
+	RateLimiter RateLimiter
+
+	// RequireHTTPS rejects broker origins using plain http, except for loopback
+	// hosts like localhost and 127.0.0.1, which are useful in development. This
+	// catches production configurations that would transport tokens insecurely.
+	RequireHTTPS bool
+
+	// HTTPClient is used for requests to the broker by the default in-memory
+	// store, for example to use a custom Transport for proxies, tracing or
+	// connection tuning. Its Timeout should be set. The default is an
+	// http.Client with DefaultHTTPTimeout. It can't be combined with a custom
+	// Store; pass it to the constructor of the Store instead. It can't be
+	// combined with TLSConfig either; configure the Transport instead.
+	HTTPClient *http.Client
+
+	// TLSConfig is used for HTTPS requests to the broker by the default
+	// in-memory store, for example to trust a private CA, require a minimum TLS
+	// version, or pin certificates using VerifyPeerCertificate. It can't be
+	// combined with a custom Store; configure the http.Client given to the
+	// Store instead.
+	TLSConfig *tls.Config
+
+	// MinCacheAge and MaxCacheAge bound the cache lifespan of broker documents
+	// in the default in-memory store, regardless of the Cache-Control header.
+	// Raising the minimum reduces load on the broker, lowering the maximum
+	// bounds how long old keys are used after key rotation. They can't be
+	// combined with a custom Store; use WithFetchOptions when creating a
+	// MemoryStore instead. The defaults are DefaultMinCacheAge and
+	// DefaultMaxCacheAge.
+	MinCacheAge time.Duration
+	MaxCacheAge time.Duration
+
+	// BrokerHeaders are added to requests for broker documents by the default
+	// in-memory store, for example an Authorization header for a broker behind
+	// an access-controlled gateway. It can't be combined with a custom Store;
+	// use WithFetchOptions and WithHeaders when creating a MemoryStore instead.
+	BrokerHeaders http.Header
+
+	// Proxy and DialContext are set on the Transport used by the default
+	// in-memory store, to route broker requests through an explicit proxy,
+	// for example using http.ProxyURL, or a custom dialer, for example for
+	// SOCKS. By default, the proxy is taken from the environment, like
+	// http.DefaultTransport does. They can't be combined with a custom Store
+	// or HTTPClient; configure the Transport instead.
+	Proxy       func(*http.Request) (*url.URL, error)
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// NonceGenerator sets the format of nonces created by the default in-memory
+	// store, for example UUIDNonceGenerator, or HexNonceGenerator(32) for 256
+	// bits of entropy. It can't be combined with a custom Store; use
+	// WithNonceGenerator when creating a MemoryStore instead.
+	NonceGenerator NonceGenerator
+
+	// ParseOptions are additional options passed to jwt.Parse when verifying
+	// tokens, for example jwt.WithPedantic(true). They are applied after the
+	// options set by the Client, and can override them, so use with care.
+	ParseOptions []jwt.ParseOption
 }
 
 // AuthOption is the interface for options accepted by StartAuth.
 type AuthOption = option.Interface
 type identAuthState struct{}
+type identAuthData struct{}
+type identAuthRateLimitKey struct{}
+type identAuthParam struct{}
 
 // WithState is used with StartAuth to add arbitrary state to the request,
 // which is returned in the `state` query parameter to the redirect URI.
@@ -50,6 +250,56 @@ func WithState(state string) AuthOption {
 	return option.New(identAuthState{}, state)
 }
 
+// WithData is used with StartAuth to attach opaque application data to the
+// session, for example a path to return to after login. The data is not sent
+// to the broker, but kept in the Store, and returned in VerifyResult.Data when
+// the session completes.
+//
+// This option requires a Store that implements SessionStore. Otherwise,
+// StartAuth returns an error matching ErrSessionStoreRequired.
+func WithData(data string) AuthOption {
+	return option.New(identAuthData{}, data)
+}
+
+// WithRateLimitKey is used with StartAuth to add a key for Config.RateLimiter
+// to consult, in addition to the email address. This is typically the IP
+// address of the user agent.
+func WithRateLimitKey(key string) AuthOption {
+	return option.New(identAuthRateLimitKey{}, key)
+}
+
+// WithAuthParam is used with StartAuth to add a query parameter to the
+// authentication URL, for example ui_locales to localize the broker pages.
+// Parameters set by StartAuth itself, such as nonce, can't be overridden.
+func WithAuthParam(name string, value string) AuthOption {
+	return option.New(identAuthParam{}, authParam{name, value})
+}
+
+type authParam struct {
+	name  string
+	value string
+}
+
+// reservedAuthParams are the query parameters set by StartAuth.
+var reservedAuthParams = map[string]bool{
+	"login_hint":    true,
+	"scope":         true,
+	"nonce":         true,
+	"response_type": true,
+	"response_mode": true,
+	"client_id":     true,
+	"redirect_uri":  true,
+	"state":         true,
+}
+
+// RateLimiter is consulted by StartAuth to throttle login attempts.
+type RateLimiter interface {
+	// Allow reports whether a login attempt for the key may proceed, and
+	// records the attempt. StartAuth calls it with the email address, and
+	// again with each key given using WithRateLimitKey.
+	Allow(key string) (bool, error)
+}
+
 // Client is used to perform Portier authentication.
 //
 // Whether a Client is safe for concurrent use by multiple goroutines depends
@@ -60,13 +310,18 @@ type Client interface {
 	// StartAuth creates a login session for the given email, and returns a URL
 	// to redirect the user agent (browser) to so authentication can continue.
 	//
+	// If email is empty, the broker asks the user for their email address. The
+	// session then accepts a token for any email address.
+	//
 	// If performing the redirect in the HTTP response, the recommended method is
 	// to send a 303 HTTP status code with the Location header set to the URL.
 	// But other solutions are possible, such as fetching this URL using a
 	// request from client-side JavaScript.
 	//
 	// Use a WithState option to add state to the request, which will be returned
-	// as the `state` query parameter to the redirect URI.
+	// as the `state` query parameter to the redirect URI. If the Store
+	// implements SessionStore, the state is also recorded with the session, so
+	// it can be validated by VerifyCallback.
 	StartAuth(email string, options ...AuthOption) (string, error)
 
 	// Verify takes an id_token and returns a verified email address.
@@ -75,18 +330,149 @@ type Client interface {
 	// (browser). It is sent either via a HTTP POST with a form body, or in the
 	// URL fragment, depending on Config.ResponseMode. (In the latter case,
 	// additional client-side JavaScript is needed, because the URL fragment is
-	// not sent to the server.) The default is HTTP POST.
+	// not sent to the server. See FragmentHandler.) The default is HTTP POST.
 	Verify(tokenStr string) (string, error)
+
+	// VerifyFull is like Verify, but returns a VerifyResult containing
+	// additional information from the token.
+	VerifyFull(tokenStr string) (*VerifyResult, error)
+
+	// ParseToken is like VerifyFull, but does not consume the nonce, so it does
+	// not complete a login session. It still fetches the broker keys, and
+	// validates the signature and claims.
+	//
+	// This is intended for tooling and debugging, or for services that accept
+	// tokens already verified by another component. Because the token can be
+	// used any number of times, it should not be used to perform logins.
+	ParseToken(tokenStr string) (*VerifyResult, error)
+
+	// VerifyToken is like Verify, but returns the parsed and validated token.
+	// This allows access to all claims, including custom claims added by the
+	// broker, without having to parse the token again.
+	VerifyToken(tokenStr string) (jwt.Token, error)
+
+	// VerifyCallback takes the parameters sent to the RedirectURI, verifies the
+	// id_token, and checks that the state parameter matches the state given to
+	// StartAuth.
+	//
+	// If the broker instead sent an error response, a *BrokerError is returned.
+	//
+	// Validating the state requires a Store that implements SessionStore, like
+	// the default in-memory store. If the Store does not, and the parameters
+	// contain a state, an error is returned.
+	VerifyCallback(params url.Values) (*VerifyResult, error)
+
+	// VerifyRequest is like VerifyCallback, but takes the parameters from an
+	// HTTP request to the RedirectURI. Both the form body of a POST request
+	// and the query string are considered.
+	VerifyRequest(r *http.Request) (*VerifyResult, error)
+
+	// ClientID returns the client ID, which is the origin of the RedirectURI.
+	ClientID() string
+
+	// Broker returns the broker origin, after applying defaults.
+	Broker() string
+
+	// RedirectURI returns the configured RedirectURI.
+	RedirectURI() string
+
+	// Warmup fetches the discovery document and key set of the broker, and of
+	// any FallbackBrokers, so they are cached in the Store before the first
+	// login. It can be called at startup to confirm the brokers are reachable
+	// before serving traffic.
+	Warmup() error
+
+	// Ping checks that the discovery document of the broker, or one of the
+	// FallbackBrokers, can be fetched, and contains the endpoints needed for
+	// login. It is suitable for readiness probes. Like a login, it uses the
+	// cache of the Store, so the broker is only contacted when the cached
+	// document has expired.
+	//
+	// If the Store implements FetchContextStore, as the default Store does,
+	// the fetch is cancelled when the context is done.
+	Ping(ctx context.Context) error
+
+	// Close releases resources held by the Client, such as idle connections
+	// and background refreshes of the default Store. A Store or HTTPClient
+	// given in Config is not closed, because it may be shared. The Client
+	// should not be used after Close.
+	Close() error
+}
+
+// VerifyResult contains information from the id_token verified by
+// Client.VerifyFull.
+type VerifyResult struct {
+	Email         string    // The verified email address
+	EmailOriginal string    // The email address as entered by the user
+	Issuer        string    // Origin of the broker that issued the token
+	ExpiresAt     time.Time // Expiry time of the token
+	IssuedAt      time.Time // Time the token was issued
+	State         string    // State given to StartAuth, if recorded
+	Data          string    // Data given to StartAuth using WithData
+
+	// Claims contains all claims not registered in RFC 7519, including the
+	// email claims above, plus any additional claims added by the broker.
+	Claims map[string]interface{}
+
+	// Token is the parsed and validated token.
+	Token jwt.Token
+}
+
+// EmailNormalized reports whether the broker normalized the email address,
+// meaning the verified email differs from what the user originally entered.
+//
+// EmailOriginal is taken from the email_original claim. If the broker did not
+// include that claim, EmailOriginal is the same as Email.
+func (result *VerifyResult) EmailNormalized() bool {
+	return result.Email != result.EmailOriginal
+}
+
+// Lifetime returns the validity period the broker asserted for the token, from
+// the iat claim to the exp claim. It returns zero if either claim is missing.
+func (result *VerifyResult) Lifetime() time.Duration {
+	if result.IssuedAt.IsZero() || result.ExpiresAt.IsZero() {
+		return 0
+	}
+	return result.ExpiresAt.Sub(result.IssuedAt)
 }
 
 type client struct {
-	store        Store
-	broker       string
-	brokerURL    *url.URL
-	redirectURI  string
-	clientID     string
-	responseMode string
-	leeway       time.Duration
+	store                Store
+	broker               string
+	brokers              []string // Broker followed by FallbackBrokers
+	redirectURI          string
+	clientID             string
+	clientIDs            map[string]bool
+	breakers             map[string]*circuitBreaker // Nil if disabled
+	responseMode         string
+	scope                string
+	leeway               time.Duration
+	expLeeway            time.Duration
+	nbfLeeway            time.Duration
+	iatLeeway            time.Duration
+	maxTokenSize         int
+	clock                func() time.Time
+	parseOptions         []jwt.ParseOption
+	allowedAlgorithms    []jwa.SignatureAlgorithm
+	pinnedKeys           map[string]bool
+	strictAudience       bool
+	checkEmailVerified   bool
+	requireEmailVerified bool
+	requiredClaims       map[string]interface{}
+	forbiddenClaims      []string
+	validators           []func(token jwt.Token) error
+	sessionTTL           time.Duration
+	rateLimiter          RateLimiter
+	allowedDomains       map[string]bool
+	deniedDomains        map[string]bool
+	emailPolicy          func(email string) error
+	retryWindow          time.Duration
+	checkTokenID         bool
+	recent               recentResults
+	keyCacheTTL          time.Duration
+	keySets              keySetCache
+	httpClient           *http.Client // Only set if the Client created it
+	ownStore             MemoryStore  // Only set if the Client created it
 }
 
 type prepResult struct {
@@ -96,16 +482,86 @@ type prepResult struct {
 
 // NewClient constructs a Client from a Config.
 func NewClient(cfg *Config) (Client, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
 	client := &client{
-		store:        cfg.Store,
-		broker:       cfg.Broker,
-		redirectURI:  cfg.RedirectURI,
-		responseMode: cfg.ResponseMode,
-		leeway:       cfg.Leeway,
+		store:                cfg.Store,
+		broker:               cfg.Broker,
+		redirectURI:          cfg.RedirectURI,
+		responseMode:         cfg.ResponseMode,
+		leeway:               cfg.Leeway,
+		expLeeway:            cfg.ExpLeeway,
+		nbfLeeway:            cfg.NbfLeeway,
+		iatLeeway:            cfg.IatLeeway,
+		maxTokenSize:         cfg.MaxTokenSize,
+		clock:                cfg.Clock,
+		parseOptions:         cfg.ParseOptions,
+		allowedAlgorithms:    cfg.AllowedAlgorithms,
+		strictAudience:       cfg.StrictAudience,
+		checkEmailVerified:   cfg.CheckEmailVerified,
+		requireEmailVerified: cfg.RequireEmailVerified,
+		requiredClaims:       cfg.RequiredClaims,
+		forbiddenClaims:      cfg.ForbiddenClaims,
+		validators:           cfg.Validators,
+		sessionTTL:           cfg.SessionTTL,
+		rateLimiter:          cfg.RateLimiter,
+		allowedDomains:       domainSet(cfg.AllowedDomains),
+		deniedDomains:        domainSet(cfg.DeniedDomains),
+		emailPolicy:          cfg.EmailPolicy,
+		retryWindow:          cfg.RetryWindow,
+		keyCacheTTL:          cfg.KeyCacheTTL,
+		checkTokenID:         cfg.CheckTokenID,
 	}
 
+	if client.clock == nil {
+		client.clock = time.Now
+	}
+	if len(cfg.PinnedKeys) != 0 {
+		client.pinnedKeys = make(map[string]bool, len(cfg.PinnedKeys))
+		for _, pin := range cfg.PinnedKeys {
+			client.pinnedKeys[pin] = true
+		}
+	}
 	if client.store == nil {
-		client.store = NewMemoryStore(&http.Client{Timeout: DefaultHTTPTimeout})
+		httpClient := cfg.HTTPClient
+		if httpClient == nil {
+			httpClient = &http.Client{Timeout: DefaultHTTPTimeout}
+			if cfg.TLSConfig != nil || cfg.Proxy != nil || cfg.DialContext != nil {
+				transport := http.DefaultTransport.(*http.Transport).Clone()
+				if cfg.TLSConfig != nil {
+					transport.TLSClientConfig = cfg.TLSConfig
+				}
+				if cfg.Proxy != nil {
+					transport.Proxy = cfg.Proxy
+				}
+				if cfg.DialContext != nil {
+					transport.DialContext = cfg.DialContext
+				}
+				httpClient.Transport = transport
+			}
+			client.httpClient = httpClient
+		}
+		storeOptions := []MemoryStoreOption{WithClock(client.clock)}
+		if cfg.NonceGenerator != nil {
+			storeOptions = append(storeOptions, WithNonceGenerator(cfg.NonceGenerator))
+		}
+		var fetchOptions []FetchOption
+		if cfg.MinCacheAge != 0 {
+			fetchOptions = append(fetchOptions, WithMinCacheAge(cfg.MinCacheAge))
+		}
+		if cfg.MaxCacheAge != 0 {
+			fetchOptions = append(fetchOptions, WithMaxCacheAge(cfg.MaxCacheAge))
+		}
+		if len(cfg.BrokerHeaders) != 0 {
+			fetchOptions = append(fetchOptions, WithHeaders(cfg.BrokerHeaders))
+		}
+		if len(fetchOptions) != 0 {
+			storeOptions = append(storeOptions, WithFetchOptions(fetchOptions...))
+		}
+		client.ownStore = NewMemoryStore(httpClient, storeOptions...)
+		client.store = client.ownStore
 	}
 	if client.broker == "" {
 		client.broker = DefaultBroker
@@ -113,125 +569,511 @@ func NewClient(cfg *Config) (Client, error) {
 	if client.responseMode == "" {
 		client.responseMode = ResponseModeFormPost
 	}
+	if len(cfg.Scopes) != 0 {
+		client.scope = strings.Join(cfg.Scopes, " ")
+	} else {
+		client.scope = DefaultScope
+	}
 	if client.leeway == 0 {
 		client.leeway = DefaultLeeway
 	}
+	if client.expLeeway == 0 {
+		client.expLeeway = client.leeway
+	}
+	if client.nbfLeeway == 0 {
+		client.nbfLeeway = client.leeway
+	}
+	if client.iatLeeway == 0 {
+		client.iatLeeway = client.leeway
+	}
+	if client.maxTokenSize == 0 {
+		client.maxTokenSize = DefaultMaxTokenSize
+	}
 
-	if client.redirectURI == "" {
-		return nil, fmt.Errorf("RedirectURI not set")
+	// Errors were already checked by Validate.
+	client.brokers = append([]string{client.broker}, cfg.FallbackBrokers...)
+	if cfg.BreakerThreshold > 0 {
+		cooldown := cfg.BreakerCooldown
+		if cooldown == 0 {
+			cooldown = DefaultBreakerCooldown
+		}
+		client.breakers = make(map[string]*circuitBreaker, len(client.brokers))
+		for _, broker := range client.brokers {
+			client.breakers[broker] = newCircuitBreaker(cfg.BreakerThreshold, cooldown)
+		}
+	}
+	redirectURI, _ := url.Parse(client.redirectURI)
+	client.clientID = originOf(redirectURI)
+	client.clientIDs = map[string]bool{client.clientID: true}
+	for _, audience := range cfg.AdditionalAudiences {
+		client.clientIDs[audience] = true
+	}
+
+	return client, nil
+}
+
+func (client *client) ClientID() string {
+	return client.clientID
+}
+
+func (client *client) Broker() string {
+	return client.broker
+}
+
+func (client *client) RedirectURI() string {
+	return client.redirectURI
+}
+
+func (client *client) Close() error {
+	if client.ownStore != nil {
+		client.ownStore.Close()
+	}
+	if client.httpClient != nil {
+		client.httpClient.CloseIdleConnections()
 	}
-	switch client.responseMode {
-	case ResponseModeFormPost:
-	case ResponseModeFragment:
-		break
+	return nil
+}
+
+// clearStoreFields clears the fields that are only used to create the default
+// Store, and can't be combined with a custom Store. Keep this in sync with the
+// checks in Validate.
+func (cfg *Config) clearStoreFields() {
+	cfg.Store = nil
+	cfg.HTTPClient = nil
+	cfg.TLSConfig = nil
+	cfg.Proxy = nil
+	cfg.DialContext = nil
+	cfg.NonceGenerator = nil
+	cfg.MinCacheAge = 0
+	cfg.MaxCacheAge = 0
+	cfg.BrokerHeaders = nil
+}
+
+// Validate checks the Config for problems that would cause NewClient to fail,
+// without creating a Client. All problems found are reported, joined using
+// errors.Join.
+func (cfg *Config) Validate() error {
+	var errs []error
+
+	if cfg.Store != nil {
+		if cfg.HTTPClient != nil {
+			errs = append(errs, fmt.Errorf("HTTPClient can't be used with a custom Store"))
+		}
+		if cfg.TLSConfig != nil {
+			errs = append(errs, fmt.Errorf("TLSConfig can't be used with a custom Store"))
+		}
+		if cfg.Proxy != nil || cfg.DialContext != nil {
+			errs = append(errs, fmt.Errorf("Proxy and DialContext can't be used with a custom Store"))
+		}
+		if cfg.NonceGenerator != nil {
+			errs = append(errs, fmt.Errorf("NonceGenerator can't be used with a custom Store"))
+		}
+		if cfg.MinCacheAge != 0 || cfg.MaxCacheAge != 0 {
+			errs = append(errs, fmt.Errorf("MinCacheAge and MaxCacheAge can't be used with a custom Store"))
+		}
+		if len(cfg.BrokerHeaders) != 0 {
+			errs = append(errs, fmt.Errorf("BrokerHeaders can't be used with a custom Store"))
+		}
+		if _, ok := cfg.Store.(SessionTTLStore); cfg.SessionTTL != 0 && !ok {
+			errs = append(errs, fmt.Errorf("SessionTTL requires a Store that implements SessionTTLStore"))
+		}
+		if _, ok := cfg.Store.(TokenIDStore); cfg.CheckTokenID && !ok {
+			errs = append(errs, fmt.Errorf("CheckTokenID requires a Store that implements TokenIDStore"))
+		}
+	}
+
+	if cfg.HTTPClient != nil && cfg.TLSConfig != nil {
+		errs = append(errs, fmt.Errorf("TLSConfig can't be used with HTTPClient"))
+	}
+	if cfg.HTTPClient != nil && (cfg.Proxy != nil || cfg.DialContext != nil) {
+		errs = append(errs, fmt.Errorf("Proxy and DialContext can't be used with HTTPClient"))
+	}
+
+	minCacheAge, maxCacheAge := DefaultMinCacheAge, DefaultMaxCacheAge
+	if cfg.MinCacheAge != 0 {
+		minCacheAge = cfg.MinCacheAge
+	}
+	if cfg.MaxCacheAge != 0 {
+		maxCacheAge = cfg.MaxCacheAge
+	}
+	if minCacheAge > maxCacheAge {
+		errs = append(errs, fmt.Errorf("MinCacheAge %s exceeds MaxCacheAge %s", minCacheAge, maxCacheAge))
+	}
+
+	switch cfg.ResponseMode {
+	case "", ResponseModeFormPost, ResponseModeFragment:
 	default:
-		return nil, fmt.Errorf("invalid ResponseMode: %s", client.responseMode)
+		errs = append(errs, fmt.Errorf("invalid ResponseMode: %s", cfg.ResponseMode))
 	}
 
-	brokerURL, err := url.Parse(client.broker)
-	if err != nil {
-		return nil, fmt.Errorf("invalid broker: %s", err.Error())
+	broker := cfg.Broker
+	if broker == "" {
+		broker = DefaultBroker
 	}
-	if !isOrigin(brokerURL) {
-		return nil, fmt.Errorf("invalid broker: URL is not an HTTP(S) origin")
+	for _, broker := range append([]string{broker}, cfg.FallbackBrokers...) {
+		if brokerURL, err := url.Parse(broker); err != nil {
+			errs = append(errs, fmt.Errorf("invalid broker: %w", err))
+		} else if !isOrigin(brokerURL) {
+			errs = append(errs, fmt.Errorf("invalid broker: URL is not an HTTP(S) origin: %s", broker))
+		} else if cfg.RequireHTTPS && brokerURL.Scheme != "https" && !isLoopback(brokerURL) {
+			errs = append(errs, fmt.Errorf("invalid broker: HTTPS is required: %s", broker))
+		}
 	}
-	client.brokerURL = brokerURL
 
-	redirectURI, err := url.Parse(client.redirectURI)
-	if err != nil {
-		return nil, fmt.Errorf("invalid redirect URI: %s", err.Error())
+	if cfg.RedirectURI == "" {
+		errs = append(errs, fmt.Errorf("RedirectURI not set"))
+	} else if redirectURI, err := url.Parse(cfg.RedirectURI); err != nil {
+		errs = append(errs, fmt.Errorf("invalid redirect URI: %w", err))
+	} else if !redirectURI.IsAbs() {
+		errs = append(errs, fmt.Errorf("invalid redirect URI: must be absolute"))
 	}
-	if !redirectURI.IsAbs() {
-		return nil, fmt.Errorf("invalid redirect URI: must be absolute")
+
+	for _, audience := range cfg.AdditionalAudiences {
+		audienceURL, err := url.Parse(audience)
+		if err != nil || !isOrigin(audienceURL) {
+			errs = append(errs, fmt.Errorf("invalid additional audience: %s", audience))
+		}
 	}
-	client.clientID = originOf(redirectURI)
 
-	return client, nil
+	return errors.Join(errs...)
 }
 
-func (client *client) fetchDiscovery() (*discoveryDoc, error) {
-	discovery := &discoveryDoc{}
-	discoveryURL := *client.brokerURL
+func (client *client) fetchDiscovery(ctx context.Context, broker string) (*discoveryDoc, error) {
+	breaker := client.breakers[broker]
+	if err := breaker.allow(broker, client.clock()); err != nil {
+		return nil, err
+	}
+
+	discoveryURL, _ := url.Parse(broker) // Checked by Validate
 	discoveryURL.Path = discoveryPath
-	if err := client.store.Fetch(discoveryURL.String(), &discovery); err != nil {
-		return nil, fmt.Errorf("could not fetch discovery document: %s", err.Error())
+	discovery, err := FetchAsContext[discoveryDoc](ctx, client.store, discoveryURL.String())
+	if ctx.Err() != nil {
+		breaker.release()
+		return nil, newError(ErrBrokerUnreachable, "discovery fetch aborted: %w", ctx.Err())
+	}
+	breaker.record(err == nil, client.clock())
+	if err != nil {
+		return nil, newError(ErrBrokerUnreachable, "could not fetch discovery document: %w", err)
 	}
 
 	return discovery, nil
 }
 
+// selectBroker returns the first broker whose discovery document can be
+// fetched, along with the document. If none can, the error for the primary
+// broker is returned.
+func (client *client) selectBroker(ctx context.Context) (string, *discoveryDoc, error) {
+	var firstErr error
+	for _, broker := range client.brokers {
+		discovery, err := client.fetchDiscovery(ctx, broker)
+		if err == nil {
+			return broker, discovery, nil
+		}
+		if ctx.Err() != nil {
+			return "", nil, err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return "", nil, firstErr
+}
+
+// tokenBroker returns the configured broker that issued the token, according
+// to its unverified iss claim. The signature is later verified using the keys
+// of that broker.
+func (client *client) tokenBroker(tokenStr string) (string, error) {
+	if len(client.brokers) == 1 {
+		return client.broker, nil
+	}
+
+	token, err := jwt.ParseInsecure([]byte(tokenStr))
+	if err != nil {
+		return "", newError(ErrInvalidToken, "jwt.Parse error: %w", err)
+	}
+	issuer := token.Issuer()
+	for _, broker := range client.brokers {
+		if broker == issuer {
+			return broker, nil
+		}
+	}
+	return "", newError(ErrInvalidIssuer, "token issued by unknown broker: %s", issuer)
+}
+
+// fetchKeys fetches the key set of the broker, and applies key pinning.
+func (client *client) fetchKeys(broker string) (jwk.Set, error) {
+	discovery, err := client.fetchDiscovery(context.Background(), broker)
+	if err != nil {
+		return nil, err
+	}
+
+	keySet := jwk.NewSet()
+	if err := client.store.Fetch(discovery.JWKsURI, &keySet); err != nil {
+		client.breakers[broker].record(false, client.clock())
+		return nil, newError(ErrBrokerUnreachable, "FetchKeys error: %w", err)
+	}
+	client.breakers[broker].record(true, client.clock())
+	if client.pinnedKeys != nil {
+		keySet = pinKeys(keySet, client.pinnedKeys)
+	}
+	if client.keyCacheTTL > 0 {
+		client.keySets.add(broker, keySet, client.clock().Add(client.keyCacheTTL))
+	}
+	return keySet, nil
+}
+
+// cachedKeys is like fetchKeys, but returns the key set from the client-side
+// cache if it is fresh. The second return value reports whether it did.
+func (client *client) cachedKeys(broker string) (jwk.Set, bool, error) {
+	if client.keyCacheTTL > 0 {
+		if keySet := client.keySets.get(broker, client.clock()); keySet != nil {
+			return keySet, true, nil
+		}
+	}
+	keySet, err := client.fetchKeys(broker)
+	return keySet, false, err
+}
+
+func (client *client) Warmup() error {
+	var errs []error
+	for _, broker := range client.brokers {
+		if _, err := client.fetchKeys(broker); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (client *client) Ping(ctx context.Context) error {
+	_, discovery, err := client.selectBroker(ctx)
+	if err != nil {
+		return err
+	}
+
+	if parsed, err := url.Parse(discovery.JWKsURI); err != nil || !parsed.IsAbs() {
+		return newError(ErrBrokerUnreachable, "discovery document has invalid jwks_uri: %q", discovery.JWKsURI)
+	}
+	if parsed, err := url.Parse(discovery.AuthorizationEndpoint); err != nil || !parsed.IsAbs() {
+		return newError(ErrBrokerUnreachable, "discovery document has invalid authorization_endpoint: %q", discovery.AuthorizationEndpoint)
+	}
+	return nil
+}
+
 func (client *client) StartAuth(email string, options ...AuthOption) (string, error) {
-	state := ""
+	session := &Session{
+		ClientID:    client.clientID,
+		RedirectURI: client.redirectURI,
+	}
+	extraParams := make(url.Values)
+	responseMode := client.responseMode
+	var rateLimitKeys []string
+	if email != "" {
+		rateLimitKeys = append(rateLimitKeys, email)
+	}
 	for _, option := range options {
 		switch option.Ident() {
 		case identAuthState{}:
-			state = option.Value().(string)
+			session.State = option.Value().(string)
+		case identAuthData{}:
+			session.Data = option.Value().(string)
+		case identAuthRateLimitKey{}:
+			rateLimitKeys = append(rateLimitKeys, option.Value().(string))
+		case identResponseMode{}:
+			responseMode = option.Value().(string)
+			if responseMode != ResponseModeFormPost && responseMode != ResponseModeFragment {
+				return "", fmt.Errorf("invalid response mode: %s", responseMode)
+			}
+		case identRedirectURI{}:
+			session.RedirectURI = option.Value().(string)
+			clientID, ok := client.clientOrigin(session.RedirectURI)
+			if !ok {
+				return "", fmt.Errorf("invalid redirect URI: must be an absolute URL with the origin of the client")
+			}
+			session.ClientID = clientID
+		case identAuthParam{}:
+			param := option.Value().(authParam)
+			if reservedAuthParams[param.name] {
+				return "", fmt.Errorf("cannot override authentication parameter: %s", param.name)
+			}
+			extraParams.Add(param.name, param.value)
 		}
 	}
 
-	discovery, err := client.fetchDiscovery()
+	if email != "" {
+		if err := validateEmail(email); err != nil {
+			return "", err
+		}
+		if err := client.checkEmail(email); err != nil {
+			return "", err
+		}
+	}
+
+	sessionStore, _ := client.store.(SessionStore)
+	if sessionStore == nil && session.Data != "" {
+		return "", newError(ErrSessionStoreRequired, "cannot store data: Store does not implement SessionStore")
+	}
+
+	if client.rateLimiter != nil {
+		for _, key := range rateLimitKeys {
+			allowed, err := client.rateLimiter.Allow(key)
+			if err != nil {
+				return "", fmt.Errorf("RateLimiter error: %w", err)
+			}
+			if !allowed {
+				return "", newError(ErrRateLimited, "too many login attempts for %s", key)
+			}
+		}
+	}
+
+	broker, discovery, err := client.selectBroker(context.Background())
 	if err != nil {
 		return "", err
 	}
+	session.Broker = broker
 
 	authURL, err := url.Parse(discovery.AuthorizationEndpoint)
 	if err != nil {
-		return "", fmt.Errorf("invalid authorization_endpoint: %s", err.Error())
+		return "", fmt.Errorf("invalid authorization_endpoint: %w", err)
 	}
 
-	nonce, err := client.store.NewNonce(email)
+	var nonce string
+	if client.sessionTTL != 0 {
+		nonce, err = client.store.(SessionTTLStore).NewSessionTTL(pairingEmail(email), session, client.sessionTTL)
+	} else if sessionStore != nil {
+		nonce, err = sessionStore.NewSession(pairingEmail(email), session)
+	} else {
+		nonce, err = client.store.NewNonce(pairingEmail(email))
+	}
 	if err != nil {
-		return "", fmt.Errorf("NewNonce error: %s", err.Error())
+		return "", fmt.Errorf("NewNonce error: %w", err)
 	}
 
-	q := make(url.Values)
-	q.Set("login_hint", email)
-	q.Set("scope", "openid email")
+	q := extraParams
+	if email != "" {
+		q.Set("login_hint", email)
+	}
+	q.Set("scope", client.scope)
 	q.Set("nonce", nonce)
 	q.Set("response_type", "id_token")
-	q.Set("response_mode", client.responseMode)
-	q.Set("client_id", client.clientID)
-	q.Set("redirect_uri", client.redirectURI)
-	if state != "" {
-		q.Set("state", state)
+	q.Set("response_mode", responseMode)
+	q.Set("client_id", session.ClientID)
+	q.Set("redirect_uri", session.RedirectURI)
+	if session.State != "" {
+		q.Set("state", session.State)
 	}
 	authURL.RawQuery = q.Encode()
 	return authURL.String(), nil
 }
 
 func (client *client) Verify(tokenStr string) (string, error) {
-	discovery, err := client.fetchDiscovery()
+	result, err := client.VerifyFull(tokenStr)
 	if err != nil {
 		return "", err
 	}
 
-	keySet := jwk.NewSet()
-	if err := client.store.Fetch(discovery.JWKsURI, &keySet); err != nil {
-		return "", fmt.Errorf("FetchKeys error: %s", err.Error())
+	return result.Email, nil
+}
+
+func (client *client) VerifyToken(tokenStr string) (jwt.Token, error) {
+	result, err := client.VerifyFull(tokenStr)
+	if err != nil {
+		return nil, err
 	}
 
-	token, err := jwt.Parse(
-		[]byte(tokenStr),
-		jwt.WithKeySet(keySet),
-		jwt.WithValidate(true),
-		jwt.WithAcceptableSkew(client.leeway),
-		jwt.WithIssuer(client.broker),
-		jwt.WithAudience(client.clientID),
-	)
+	return result.Token, nil
+}
+
+func (client *client) VerifyCallback(params url.Values) (*VerifyResult, error) {
+	state := params.Get("state")
+	if code := params.Get("error"); code != "" {
+		return nil, &BrokerError{
+			Code:        code,
+			Description: params.Get("error_description"),
+			State:       state,
+		}
+	}
+
+	if _, ok := client.store.(SessionStore); !ok && state != "" {
+		return nil, newError(ErrSessionStoreRequired, "cannot validate state: Store does not implement SessionStore")
+	}
+
+	tokenStr := params.Get("id_token")
+	if tokenStr == "" {
+		return nil, newError(ErrInvalidToken, "id_token parameter missing")
+	}
+
+	result, err := client.VerifyFull(tokenStr)
 	if err != nil {
-		return "", fmt.Errorf("jwt.Parse error: %s", err.Error())
+		return nil, err
 	}
 
-	nonceVal, _ := token.Get("nonce")
-	nonce, _ := nonceVal.(string)
-	if nonce == "" {
-		return "", fmt.Errorf("nonce claim missing")
+	if result.State != state {
+		return nil, newError(ErrInvalidSession, "state mismatch")
+	}
+
+	return result, nil
+}
+
+func (client *client) VerifyRequest(r *http.Request) (*VerifyResult, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, fmt.Errorf("could not parse request: %w", err)
+	}
+
+	return client.VerifyCallback(r.Form)
+}
+
+func (client *client) ParseToken(tokenStr string) (*VerifyResult, error) {
+	if len(tokenStr) > client.maxTokenSize {
+		return nil, newError(ErrInvalidToken, "token exceeds maximum size of %d bytes", client.maxTokenSize)
+	}
+
+	broker, err := client.tokenBroker(tokenStr)
+	if err != nil {
+		return nil, err
+	}
+
+	keySet, cached, err := client.cachedKeys(broker)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkHeaders(tokenStr, keySet, client.allowedAlgorithms)
+	if errors.Is(err, ErrUnknownKey) && cached {
+		// The broker may have rotated keys since they were cached.
+		if keySet, err = client.fetchKeys(broker); err != nil {
+			return nil, err
+		}
+		err = checkHeaders(tokenStr, keySet, client.allowedAlgorithms)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	parseOptions := []jwt.ParseOption{
+		jwt.WithKeySet(keySet, jws.WithInferAlgorithmFromKey(true)),
+		jwt.WithValidate(true),
+		jwt.WithAcceptableSkew(client.maxLeeway()),
+		jwt.WithClock(jwt.ClockFunc(client.clock)),
+		jwt.WithIssuer(broker),
+	}
+	parseOptions = append(parseOptions, client.parseOptions...)
+	token, err := jwt.Parse([]byte(tokenStr), parseOptions...)
+	if err != nil {
+		return nil, parseError(err)
 	}
 
 	emailVal, _ := token.Get("email")
 	email, _ := emailVal.(string)
 	if email == "" {
-		return "", fmt.Errorf("email claim missing")
+		return nil, newError(ErrInvalidToken, "email claim missing")
+	}
+
+	if err := client.checkEmail(email); err != nil {
+		return nil, err
+	}
+
+	if err := client.checkClaims(token); err != nil {
+		return nil, err
 	}
 
 	emailOrigVal, _ := token.Get("email_original")
@@ -240,12 +1082,118 @@ func (client *client) Verify(tokenStr string) (string, error) {
 		emailOrig = email
 	}
 
-	if err := client.store.ConsumeNonce(nonce, emailOrig); err != nil {
-		if _, ok := err.(*InvalidNonce); ok {
-			return "", fmt.Errorf("invalid session")
+	return &VerifyResult{
+		Email:         email,
+		EmailOriginal: emailOrig,
+		Issuer:        token.Issuer(),
+		ExpiresAt:     token.Expiration(),
+		IssuedAt:      token.IssuedAt(),
+		Claims:        token.PrivateClaims(),
+		Token:         token,
+	}, nil
+}
+
+// consumeTokenID records the jti claim of the token, and returns an error if
+// it was already recorded.
+func (client *client) consumeTokenID(token jwt.Token) error {
+	id := token.JwtID()
+	if id == "" {
+		return nil
+	}
+
+	expires := token.Expiration()
+	if expires.IsZero() {
+		expires = client.clock().Add(DefaultNonceTTL)
+	}
+	fresh, err := client.store.(TokenIDStore).ConsumeTokenID(id, expires.Add(client.expLeeway))
+	if err != nil {
+		return fmt.Errorf("ConsumeTokenID error: %w", err)
+	}
+	if !fresh {
+		return newError(ErrInvalidSession, "token already used")
+	}
+	return nil
+}
+
+// clientOrigin returns the origin of a URL, and whether it is one of the
+// client IDs of this client.
+func (client *client) clientOrigin(rawURL string) (string, bool) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || !parsed.IsAbs() {
+		return "", false
+	}
+	origin := originOf(parsed)
+	return origin, client.clientIDs[origin]
+}
+
+// consumeSession consumes the nonce/email pair from the Store, and returns the
+// session data, if the Store keeps any.
+func (client *client) consumeSession(nonce string, email string) (*Session, error) {
+	if sessionStore, ok := client.store.(SessionStore); ok {
+		return sessionStore.ConsumeSession(nonce, email)
+	}
+	return &Session{}, client.store.ConsumeNonce(nonce, email)
+}
+
+func (client *client) VerifyFull(tokenStr string) (*VerifyResult, error) {
+	if client.retryWindow > 0 {
+		if result := client.recent.get(tokenStr, client.clock()); result != nil {
+			return result, nil
 		}
-		return "", fmt.Errorf("ConsumeNonce error: %s", err.Error())
 	}
 
-	return email, nil
+	result, err := client.ParseToken(tokenStr)
+	if err != nil {
+		return nil, err
+	}
+
+	nonceVal, _ := result.Token.Get("nonce")
+	nonce, _ := nonceVal.(string)
+	if nonce == "" {
+		return nil, newError(ErrInvalidToken, "nonce claim missing")
+	}
+
+	var invalidNonce *InvalidNonce
+	session, err := client.consumeSession(nonce, pairingEmail(result.EmailOriginal))
+	if errors.As(err, &invalidNonce) {
+		// The session may have been started without an email address.
+		session, err = client.consumeSession(nonce, "")
+	}
+	if err != nil {
+		if errors.As(err, &invalidNonce) {
+			return nil, &clientError{ErrInvalidSession, "invalid session", err}
+		}
+		return nil, fmt.Errorf("ConsumeNonce error: %w", err)
+	}
+
+	// Sessions in a shared store may have been started by a different client.
+	// Sessions without these fields were created by an older version.
+	if session.ClientID != "" && !client.clientIDs[session.ClientID] {
+		return nil, newError(ErrInvalidSession, "session started by a different client: %s", session.ClientID)
+	}
+	if _, ok := client.clientOrigin(session.RedirectURI); session.RedirectURI != "" && !ok {
+		return nil, newError(ErrInvalidSession, "session started with a redirect URI of a different client: %s", session.RedirectURI)
+	}
+	if session.ClientID != "" && !containsString(result.Token.Audience(), session.ClientID) {
+		return nil, newError(ErrInvalidAudience, "token not issued for the client that started the session: %s", session.ClientID)
+	}
+	if session.Broker != "" && result.Token.Issuer() != session.Broker {
+		return nil, newError(ErrInvalidIssuer, "token not issued by the broker of the session: %s", session.Broker)
+	}
+
+	// The token ID is only recorded once the session is completed, so a token
+	// rejected above can still be retried.
+	if client.checkTokenID {
+		if err := client.consumeTokenID(result.Token); err != nil {
+			return nil, err
+		}
+	}
+
+	result.State = session.State
+	result.Data = session.Data
+	if client.retryWindow > 0 {
+		now := client.clock()
+		client.recent.add(tokenStr, result, now, now.Add(client.retryWindow))
+	}
+	return result, nil
 }
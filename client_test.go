@@ -0,0 +1,589 @@
+package portier_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/portier/portier-go"
+	"github.com/portier/portier-go/portiertest"
+)
+
+const testRedirectURI = "https://app.test/verify"
+
+// newTestClient starts a fake broker and creates a Client for it. The config
+// function, if not nil, can adjust the Config before the Client is created.
+func newTestClient(t *testing.T, config func(cfg *portier.Config)) (*portiertest.Broker, portier.Client) {
+	t.Helper()
+
+	broker := portiertest.NewBroker()
+	t.Cleanup(broker.Close)
+
+	cfg := broker.Config(testRedirectURI)
+	if config != nil {
+		config(cfg)
+	}
+	client, err := portier.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return broker, client
+}
+
+// startAuth starts a login, and returns the nonce sent to the broker.
+func startAuth(t *testing.T, client portier.Client, email string, options ...portier.AuthOption) string {
+	t.Helper()
+
+	authURL, err := client.StartAuth(email, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Query().Get("nonce")
+}
+
+func TestVerifyEdDSA(t *testing.T) {
+	broker, client := newTestClient(t, func(cfg *portier.Config) {
+		cfg.AllowedAlgorithms = []jwa.SignatureAlgorithm{jwa.EdDSA}
+	})
+	if err := broker.RotateKeyWithAlgorithm(jwa.EdDSA); err != nil {
+		t.Fatal(err)
+	}
+
+	authURL, err := client.StartAuth("user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, err := broker.Complete(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := client.VerifyCallback(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Email != "user@example.com" {
+		t.Errorf("unexpected email: %s", result.Email)
+	}
+}
+
+func TestVerifyRejectsDisallowedAlgorithm(t *testing.T) {
+	broker, client := newTestClient(t, func(cfg *portier.Config) {
+		cfg.AllowedAlgorithms = []jwa.SignatureAlgorithm{jwa.EdDSA}
+	})
+
+	// The broker still signs with its initial RSA key.
+	nonce := startAuth(t, client, "user@example.com")
+	tokenStr, err := broker.Token("user@example.com", nonce, client.ClientID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Verify(tokenStr); !errors.Is(err, portier.ErrInvalidSignature) {
+		t.Errorf("got %v, want ErrInvalidSignature", err)
+	}
+}
+
+// withHeaders returns the token with its protected header modified. The
+// signature is kept, so it no longer verifies.
+func withHeaders(t *testing.T, tokenStr string, modify func(headers map[string]interface{})) string {
+	t.Helper()
+
+	parts := strings.Split(tokenStr, ".")
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var headers map[string]interface{}
+	if err := json.Unmarshal(data, &headers); err != nil {
+		t.Fatal(err)
+	}
+	modify(headers)
+	if data, err = json.Marshal(headers); err != nil {
+		t.Fatal(err)
+	}
+	parts[0] = base64.RawURLEncoding.EncodeToString(data)
+	return strings.Join(parts, ".")
+}
+
+func TestVerifyRejectsUnexpectedHeaders(t *testing.T) {
+	broker, client := newTestClient(t, nil)
+	nonce := startAuth(t, client, "user@example.com")
+	tokenStr, err := broker.Token("user@example.com", nonce, client.ClientID())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(headers map[string]interface{})
+		want   error
+	}{
+		{"crit", func(h map[string]interface{}) { h["crit"] = []string{"exp"}; h["exp"] = 1 }, portier.ErrInvalidToken},
+		{"typ", func(h map[string]interface{}) { h["typ"] = "at+jwt" }, portier.ErrInvalidToken},
+		{"alg none", func(h map[string]interface{}) { h["alg"] = "none" }, portier.ErrInvalidSignature},
+		{"unknown kid", func(h map[string]interface{}) { h["kid"] = "unknown" }, portier.ErrUnknownKey},
+	}
+	for _, test := range tests {
+		_, err := client.ParseToken(withHeaders(t, tokenStr, test.modify))
+		if !errors.Is(err, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+
+	// The unmodified token is still accepted.
+	if _, err := client.Verify(tokenStr); err != nil {
+		t.Error(err)
+	}
+}
+
+// brokerThumbprints returns the thumbprints of the keys in the key set of the
+// broker, in order.
+func brokerThumbprints(t *testing.T, broker *portiertest.Broker) []string {
+	t.Helper()
+
+	keySet, err := jwk.Fetch(context.Background(), broker.URL+"/jwks.json", jwk.WithHTTPClient(broker.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var thumbprints []string
+	for i := 0; i < keySet.Len(); i++ {
+		key, _ := keySet.Key(i)
+		thumbprint, err := portier.KeyThumbprint(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		thumbprints = append(thumbprints, thumbprint)
+	}
+	return thumbprints
+}
+
+func TestVerifyPinnedKeys(t *testing.T) {
+	broker := portiertest.NewBroker()
+	defer broker.Close()
+	pinned := brokerThumbprints(t, broker)
+
+	cfg := broker.Config(testRedirectURI)
+	cfg.PinnedKeys = pinned
+	client, err := portier.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nonce := startAuth(t, client, "user@example.com")
+	tokenStr, err := broker.Token("user@example.com", nonce, client.ClientID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Verify(tokenStr); err != nil {
+		t.Fatalf("token signed with a pinned key: %s", err)
+	}
+
+	// A new key in the key set is not trusted. Use a new client, so the key
+	// set isn't served from the cache.
+	if err := broker.RotateKey(); err != nil {
+		t.Fatal(err)
+	}
+	if got := brokerThumbprints(t, broker); len(got) != 2 {
+		t.Fatalf("expected 2 keys, got %d", len(got))
+	}
+	cfg = broker.Config(testRedirectURI)
+	cfg.PinnedKeys = pinned
+	if client, err = portier.NewClient(cfg); err != nil {
+		t.Fatal(err)
+	}
+	nonce = startAuth(t, client, "user@example.com")
+	tokenStr, err = broker.Token("user@example.com", nonce, client.ClientID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Verify(tokenStr); !errors.Is(err, portier.ErrUnknownKey) {
+		t.Errorf("token signed with an unpinned key: got %v, want ErrUnknownKey", err)
+	}
+}
+
+// signLogin signs a token for a login of user@example.com, with the given
+// audience claim.
+func signLogin(t *testing.T, broker *portiertest.Broker, nonce string, audience interface{}) string {
+	t.Helper()
+
+	tokenStr, err := broker.Sign(map[string]interface{}{
+		"aud":   audience,
+		"sub":   "user@example.com",
+		"email": "user@example.com",
+		"nonce": nonce,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokenStr
+}
+
+func TestVerifyAudienceArray(t *testing.T) {
+	tests := []struct {
+		name     string
+		strict   bool
+		audience func(clientID string) interface{}
+		want     error
+	}{
+		{"single", false, func(id string) interface{} { return []string{id} }, nil},
+		{"multiple", false, func(id string) interface{} { return []string{"https://other.test", id} }, nil},
+		{"multiple strict", true, func(id string) interface{} { return []string{"https://other.test", id} }, portier.ErrInvalidAudience},
+		{"missing", false, func(id string) interface{} { return []string{"https://other.test"} }, portier.ErrInvalidAudience},
+	}
+	for _, test := range tests {
+		broker, client := newTestClient(t, func(cfg *portier.Config) {
+			cfg.StrictAudience = test.strict
+		})
+		nonce := startAuth(t, client, "user@example.com")
+		_, err := client.Verify(signLogin(t, broker, nonce, test.audience(client.ClientID())))
+		if test.want == nil && err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if test.want != nil && !errors.Is(err, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+}
+
+func TestVerifyTokenIDReplay(t *testing.T) {
+	broker, client := newTestClient(t, func(cfg *portier.Config) {
+		cfg.CheckTokenID = true
+	})
+	sign := func(nonce string) string {
+		tokenStr, err := broker.Sign(map[string]interface{}{
+			"aud":   client.ClientID(),
+			"sub":   "user@example.com",
+			"email": "user@example.com",
+			"nonce": nonce,
+			"jti":   "token-1",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tokenStr
+	}
+
+	// A token that fails the session check doesn't use up its ID.
+	if _, err := client.Verify(sign("unknown")); !errors.Is(err, portier.ErrInvalidSession) {
+		t.Fatalf("unknown nonce: got %v, want ErrInvalidSession", err)
+	}
+	if _, err := client.Verify(sign(startAuth(t, client, "user@example.com"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// The ID can't be used for another session.
+	if _, err := client.Verify(sign(startAuth(t, client, "user@example.com"))); !errors.Is(err, portier.ErrInvalidSession) {
+		t.Errorf("replayed token ID: got %v, want ErrInvalidSession", err)
+	}
+}
+
+func TestVerifySessionOfOtherClient(t *testing.T) {
+	broker := portiertest.NewBroker()
+	defer broker.Close()
+
+	// Two sites sharing a store.
+	cfg := broker.Config("https://one.test/verify")
+	one, err := portier.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.RedirectURI = "https://two.test/verify"
+	two, err := portier.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nonce := startAuth(t, one, "user@example.com")
+	tokenStr, err := broker.Token("user@example.com", nonce, two.ClientID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := two.Verify(tokenStr); !errors.Is(err, portier.ErrInvalidSession) {
+		t.Errorf("got %v, want ErrInvalidSession", err)
+	}
+}
+
+func TestPingCancel(t *testing.T) {
+	var slow atomic.Bool
+	slow.Store(true)
+	release := make(chan struct{})
+	broker := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slow.Load() {
+			<-release
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"jwks_uri": "%[1]s/jwks.json", "authorization_endpoint": "%[1]s/auth"}`, "https://"+r.Host)
+	}))
+	defer broker.Close()
+	defer close(release)
+
+	client, err := portier.NewClient(&portier.Config{
+		Store:       portier.NewMemoryStore(broker.Client()),
+		Broker:      broker.URL,
+		RedirectURI: testRedirectURI,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := client.Ping(ctx); !errors.Is(err, portier.ErrBrokerUnreachable) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want ErrBrokerUnreachable and DeadlineExceeded", err)
+	}
+
+	// The cancelled fetch is not cached.
+	slow.Store(false)
+	if err := client.Ping(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVerifyIssuerOfSession(t *testing.T) {
+	fallback := portiertest.NewBroker()
+	defer fallback.Close()
+	primary, client := newTestClient(t, func(cfg *portier.Config) {
+		cfg.FallbackBrokers = []string{fallback.URL}
+	})
+
+	// The primary broker is up, so the session is recorded with it.
+	nonce := startAuth(t, client, "user@example.com")
+	tokenStr, err := fallback.Token("user@example.com", nonce, client.ClientID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Verify(tokenStr); !errors.Is(err, portier.ErrInvalidIssuer) {
+		t.Errorf("token from the fallback broker: got %v, want ErrInvalidIssuer", err)
+	}
+
+	nonce = startAuth(t, client, "user@example.com")
+	if tokenStr, err = primary.Token("user@example.com", nonce, client.ClientID()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Verify(tokenStr); err != nil {
+		t.Errorf("token from the primary broker: %s", err)
+	}
+}
+
+func TestVerifyKeyCache(t *testing.T) {
+	tests := []struct {
+		name string
+		ttl  time.Duration
+		want error
+	}{
+		{"disabled", 0, portier.ErrUnknownKey},
+		{"enabled", time.Hour, nil},
+	}
+	for _, test := range tests {
+		broker := portiertest.NewBroker()
+		defer broker.Close()
+		now := time.Now()
+		clock := func() time.Time { return now }
+		cfg := broker.Config(testRedirectURI)
+		cfg.Store = portier.NewMemoryStore(broker.Client(), portier.WithClock(clock))
+		cfg.Clock = clock
+		cfg.KeyCacheTTL = test.ttl
+		client, err := portier.NewClient(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var tokens []string
+		for i := 0; i < 2; i++ {
+			nonce := startAuth(t, client, "user@example.com")
+			tokenStr, err := broker.Token("user@example.com", nonce, client.ClientID())
+			if err != nil {
+				t.Fatal(err)
+			}
+			tokens = append(tokens, tokenStr)
+		}
+		if _, err := client.Verify(tokens[0]); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		// Remove the signing key from the broker, and let the copy of the key
+		// set in the Store expire.
+		if err := broker.RotateKey(); err != nil {
+			t.Fatal(err)
+		}
+		broker.RetireKeys()
+		now = now.Add(2 * time.Minute)
+
+		_, err = client.Verify(tokens[1])
+		if test.want == nil && err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if test.want != nil && !errors.Is(err, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+}
+
+func TestPingCancelDuringBreakerProbe(t *testing.T) {
+	var healthy atomic.Bool
+	broker := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"jwks_uri": "%[1]s/jwks.json", "authorization_endpoint": "%[1]s/auth"}`, "https://"+r.Host)
+	}))
+	defer broker.Close()
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+	client, err := portier.NewClient(&portier.Config{
+		Store:            portier.NewMemoryStore(broker.Client(), portier.WithClock(clock)),
+		Clock:            clock,
+		Broker:           broker.URL,
+		RedirectURI:      testRedirectURI,
+		BreakerThreshold: 1,
+		BreakerCooldown:  time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.StartAuth("user@example.com"); !errors.Is(err, portier.ErrBrokerUnreachable) {
+		t.Fatalf("got %v, want ErrBrokerUnreachable", err)
+	}
+
+	// After the cooldown, a cancelled Ping is allowed through as the probe.
+	now = now.Add(2 * time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := client.Ping(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want Canceled", err)
+	}
+
+	// The aborted probe doesn't keep the breaker open.
+	healthy.Store(true)
+	now = now.Add(time.Hour)
+	if _, err := client.StartAuth("user@example.com"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVerifyRetryWindow(t *testing.T) {
+	now := time.Now()
+	broker, client := newTestClient(t, func(cfg *portier.Config) {
+		cfg.Clock = func() time.Time { return now }
+		cfg.RetryWindow = 10 * time.Second
+	})
+	nonce := startAuth(t, client, "user@example.com")
+	tokenStr, err := broker.Token("user@example.com", nonce, client.ClientID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Verify(tokenStr); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same token is accepted again within the window.
+	now = now.Add(5 * time.Second)
+	email, err := client.Verify(tokenStr)
+	if err != nil {
+		t.Fatalf("token within the retry window: %s", err)
+	}
+	if email != "user@example.com" {
+		t.Errorf("unexpected email: %s", email)
+	}
+
+	// A different token for the same nonce is not.
+	other, err := broker.Sign(map[string]interface{}{
+		"aud":   client.ClientID(),
+		"sub":   "user@example.com",
+		"email": "user@example.com",
+		"nonce": nonce,
+		"jti":   "other",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Verify(other); !errors.Is(err, portier.ErrInvalidSession) {
+		t.Errorf("other token for the nonce: got %v, want ErrInvalidSession", err)
+	}
+
+	// After the window, the token is rejected.
+	now = now.Add(5 * time.Second)
+	if _, err := client.Verify(tokenStr); !errors.Is(err, portier.ErrInvalidSession) {
+		t.Errorf("token after the retry window: got %v, want ErrInvalidSession", err)
+	}
+}
+
+func TestFallbackBrokers(t *testing.T) {
+	primary := portiertest.NewBroker()
+	defer primary.Close()
+	fallback := portiertest.NewBroker()
+	defer fallback.Close()
+
+	// Put the primary broker behind a proxy that can simulate an outage.
+	var down atomic.Bool
+	target, _ := url.Parse(primary.URL)
+	reverseProxy := httputil.NewSingleHostReverseProxy(target)
+	reverseProxy.Transport = primary.Client().Transport
+	proxy := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		reverseProxy.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+	client, err := portier.NewClient(&portier.Config{
+		Store:           portier.NewMemoryStore(proxy.Client(), portier.WithClock(clock)),
+		Clock:           clock,
+		Broker:          proxy.URL,
+		FallbackBrokers: []string{fallback.URL},
+		RedirectURI:     testRedirectURI,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// While the primary broker is down, logins go through the fallback.
+	down.Store(true)
+	authURL, err := client.StartAuth("user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(authURL, fallback.URL+"/auth?") {
+		t.Fatalf("login not sent to the fallback broker: %s", authURL)
+	}
+	params, err := fallback.Complete(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.VerifyCallback(params); err != nil {
+		t.Errorf("login through the fallback broker: %s", err)
+	}
+
+	// Once the primary broker recovers, and the cached error expires, logins
+	// go through the primary again.
+	down.Store(false)
+	now = now.Add(time.Hour)
+	if authURL, err = client.StartAuth("user@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(authURL, primary.URL+"/auth?") {
+		t.Errorf("login not sent to the recovered primary broker: %s", authURL)
+	}
+}
@@ -0,0 +1,259 @@
+// Command portier-check probes a Portier broker for conformance. It fetches
+// the discovery document and key set, validates the fields a client relies
+// on, checks cache headers and key types, and optionally performs a full
+// interactive login.
+//
+// Usage:
+//
+//	portier-check [-login user@example.com] https://broker.example.com
+//
+// The exit code is non-zero if any check failed.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/portier/portier-go"
+)
+
+const discoveryPath = "/.well-known/openid-configuration"
+
+type checker struct {
+	http   *http.Client
+	failed bool
+}
+
+func (c *checker) ok(format string, args ...interface{}) {
+	fmt.Printf("ok    "+format+"\n", args...)
+}
+
+func (c *checker) warn(format string, args ...interface{}) {
+	fmt.Printf("warn  "+format+"\n", args...)
+}
+
+func (c *checker) fail(format string, args ...interface{}) {
+	fmt.Printf("FAIL  "+format+"\n", args...)
+	c.failed = true
+}
+
+func main() {
+	login := flag.String("login", "", "perform an interactive login for this email address")
+	listen := flag.String("listen", "127.0.0.1:8123", "address for the login callback server")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: portier-check [flags] <broker>")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	broker := strings.TrimSuffix(flag.Arg(0), "/")
+
+	c := &checker{http: &http.Client{Timeout: portier.DefaultHTTPTimeout}}
+	c.checkBroker(broker)
+	if *login != "" && !c.failed {
+		c.checkLogin(broker, *login, *listen)
+	}
+
+	if c.failed {
+		os.Exit(1)
+	}
+}
+
+// fetch performs a GET request, checks the basic response properties, and
+// returns the body.
+func (c *checker) fetch(name string, url string) []byte {
+	res, err := c.http.Get(url)
+	if err != nil {
+		c.fail("%s: request failed: %s", name, err)
+		return nil
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		c.fail("%s: unexpected HTTP status: %s", name, res.Status)
+		return nil
+	}
+	c.ok("%s: fetched %s", name, url)
+
+	if ct := res.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") &&
+		!strings.HasPrefix(ct, "application/jwk-set+json") {
+		c.warn("%s: unexpected Content-Type: %q", name, ct)
+	}
+	if cc := res.Header.Get("Cache-Control"); !strings.Contains(cc, "max-age") {
+		c.warn("%s: no max-age in Cache-Control (%q), clients will refetch often", name, cc)
+	} else {
+		c.ok("%s: Cache-Control: %s", name, cc)
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		c.fail("%s: could not read body: %s", name, err)
+		return nil
+	}
+	return body
+}
+
+func (c *checker) checkBroker(broker string) {
+	body := c.fetch("discovery", broker+discoveryPath)
+	if body == nil {
+		return
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		c.fail("discovery: invalid JSON: %s", err)
+		return
+	}
+
+	if issuer, _ := doc["issuer"].(string); issuer != broker {
+		c.fail("discovery: issuer %q does not match broker origin %q", issuer, broker)
+	} else {
+		c.ok("discovery: issuer matches broker origin")
+	}
+	for _, field := range []string{"authorization_endpoint", "jwks_uri"} {
+		if value, _ := doc[field].(string); value == "" {
+			c.fail("discovery: %s missing", field)
+		} else {
+			c.ok("discovery: %s: %s", field, value)
+		}
+	}
+	c.checkList(doc, "response_types_supported", "id_token")
+	c.checkList(doc, "response_modes_supported", portier.ResponseModeFormPost, portier.ResponseModeFragment)
+
+	jwksURI, _ := doc["jwks_uri"].(string)
+	if jwksURI == "" {
+		return
+	}
+	body = c.fetch("jwks", jwksURI)
+	if body == nil {
+		return
+	}
+
+	keySet, err := jwk.Parse(body)
+	if err != nil {
+		c.fail("jwks: invalid key set: %s", err)
+		return
+	}
+	if keySet.Len() == 0 {
+		c.fail("jwks: key set is empty")
+		return
+	}
+
+	for i := 0; i < keySet.Len(); i++ {
+		key, _ := keySet.Key(i)
+		name := fmt.Sprintf("jwks: key %q", key.KeyID())
+		if key.KeyID() == "" {
+			c.warn("jwks: key #%d has no kid", i)
+		}
+		switch key.KeyType() {
+		case jwa.RSA, jwa.OKP, jwa.EC:
+			c.ok("%s: type %s, alg %s", name, key.KeyType(), key.Algorithm())
+		default:
+			c.fail("%s: unsupported key type %s", name, key.KeyType())
+		}
+		if use := key.KeyUsage(); use != "" && use != string(jwk.ForSignature) {
+			c.fail("%s: unexpected use %q", name, use)
+		}
+		if isPrivate, _ := jwk.IsPrivateKey(key); isPrivate {
+			c.fail("%s: contains private key material", name)
+		}
+	}
+}
+
+// checkList checks that a discovery field is a list containing the values.
+func (c *checker) checkList(doc map[string]interface{}, field string, values ...string) {
+	list, ok := doc[field].([]interface{})
+	if !ok {
+		c.warn("discovery: %s missing", field)
+		return
+	}
+
+	for _, value := range values {
+		found := false
+		for _, item := range list {
+			if item == value {
+				found = true
+			}
+		}
+		if found {
+			c.ok("discovery: %s includes %s", field, value)
+		} else {
+			c.fail("discovery: %s does not include %s", field, value)
+		}
+	}
+}
+
+func (c *checker) checkLogin(broker string, email string, listen string) {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		c.fail("login: could not listen: %s", err)
+		return
+	}
+
+	client, err := portier.NewClient(&portier.Config{
+		Broker:      broker,
+		RedirectURI: "http://" + listener.Addr().String() + "/verify",
+	})
+	if err != nil {
+		c.fail("login: portier.NewClient error: %s", err)
+		return
+	}
+
+	authURL, err := client.StartAuth(email)
+	if err != nil {
+		c.fail("login: StartAuth error: %s", err)
+		return
+	}
+	c.ok("login: started session")
+	fmt.Printf("\nOpen this URL in a browser to continue:\n\n  %s\n\n", authURL)
+
+	done := make(chan error, 1)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/verify" {
+			http.NotFound(w, r)
+			return
+		}
+		// Only the first callback is reported. Later ones, for example from a
+		// browser refresh, must not block the handler.
+		result, err := client.VerifyRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			select {
+			case done <- err:
+			default:
+			}
+			return
+		}
+		fmt.Fprintf(w, "Verified %s, you can close this window.", result.Email)
+		select {
+		case done <- nil:
+			c.ok("login: verified %s (lifetime %s)", result.Email, result.Lifetime())
+		default:
+		}
+	})}
+	go server.Serve(listener)
+
+	select {
+	case err = <-done:
+		if err != nil {
+			c.fail("login: verification failed: %s", err)
+		}
+	case <-time.After(portier.DefaultNonceTTL):
+		c.fail("login: timed out waiting for the callback")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), portier.DefaultHTTPTimeout)
+	defer cancel()
+	server.Shutdown(ctx)
+}
@@ -0,0 +1,128 @@
+// Command portier-proxy is an authenticating reverse proxy. It sits in front
+// of an upstream HTTP service, requires users to log in using Portier, and
+// forwards the verified email address to the upstream in a request header.
+//
+// Usage:
+//
+//	portier-proxy -public-url https://app.example.com -upstream http://127.0.0.1:8080
+//
+// The session signing secret is read from the PORTIER_PROXY_SECRET environment
+// variable. If it is not set, a random secret is generated, and sessions do
+// not survive a restart of the proxy.
+package main
+
+import (
+	"crypto/rand"
+	"flag"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/portier/portier-go"
+	"github.com/portier/portier-go/portierhttp"
+)
+
+// authPrefix is the path prefix under which the login flow is served.
+const authPrefix = "/.portier"
+
+func main() {
+	listen := flag.String("listen", ":4180", "address to listen on")
+	publicURL := flag.String("public-url", "", "public origin of the proxy (required)")
+	upstream := flag.String("upstream", "", "URL of the upstream service (required)")
+	broker := flag.String("broker", portier.DefaultBroker, "origin of the Portier broker")
+	header := flag.String("header", "X-Forwarded-Email", "request header to pass the email address in")
+	insecure := flag.Bool("insecure-cookie", false, "allow the session cookie over plain HTTP")
+	flag.Parse()
+
+	if *publicURL == "" || *upstream == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	upstreamURL, err := url.Parse(*upstream)
+	if err != nil {
+		log.Fatal("invalid upstream URL:", err)
+	}
+
+	client, err := portier.NewClient(&portier.Config{
+		Broker:      *broker,
+		RedirectURI: strings.TrimSuffix(*publicURL, "/") + authPrefix + "/verify",
+	})
+	if err != nil {
+		log.Fatal("portier.NewClient error:", err)
+	}
+
+	session := &portierhttp.CookieSession{
+		Secret:   loadSecret(),
+		Name:     "portier_proxy",
+		Insecure: *insecure,
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(upstreamURL)
+	protected := portierhttp.RequireLogin(session, authPrefix+"/")(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			email, _ := portierhttp.EmailFromContext(r.Context())
+			// The session cookie is a bearer credential for the proxy, and must
+			// not leak to the upstream.
+			removeCookie(r, session.Name)
+			r.Header.Set(*header, email)
+			proxy.ServeHTTP(w, r)
+		}),
+	)
+
+	mux := http.NewServeMux()
+	mux.Handle(authPrefix+"/", http.StripPrefix(authPrefix, &portierhttp.LoginFlow{
+		Client:  client,
+		Session: session,
+	}))
+	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Never trust the header from the client.
+		removeHeader(r, *header)
+		protected.ServeHTTP(w, r)
+	}))
+
+	log.Printf("listening on %s, proxying to %s", *listen, upstreamURL)
+	log.Fatal(http.ListenAndServe(*listen, mux))
+}
+
+func loadSecret() []byte {
+	if secret := os.Getenv("PORTIER_PROXY_SECRET"); secret != "" {
+		if len(secret) < portierhttp.MinSecretSize {
+			log.Fatalf("PORTIER_PROXY_SECRET must be at least %d bytes", portierhttp.MinSecretSize)
+		}
+		return []byte(secret)
+	}
+
+	log.Print("PORTIER_PROXY_SECRET not set, generating a random secret")
+	secret := make([]byte, portierhttp.MinSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		log.Fatal("secret generator error:", err)
+	}
+	return secret
+}
+
+// removeHeader deletes all variants of a header from the request. Headers
+// received by the server are canonicalized, but a header name that isn't a
+// valid token is kept as sent.
+func removeHeader(r *http.Request, name string) {
+	for key := range r.Header {
+		if strings.EqualFold(key, name) {
+			delete(r.Header, key)
+		}
+	}
+}
+
+// removeCookie deletes the cookie with the given name from the request,
+// keeping other cookies.
+func removeCookie(r *http.Request, name string) {
+	cookies := r.Cookies()
+	removeHeader(r, "Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name != name {
+			r.AddCookie(cookie)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+// Command portier-rest exposes a portier.Client as a JSON API, so applications
+// written in other languages can use this implementation over HTTP.
+//
+// Usage:
+//
+//	portier-rest -redirect-uri https://app.example.com/verify
+//
+// Endpoints:
+//
+//	POST /auth    {"email": "...", "state": "..."}     -> {"url": "..."}
+//	POST /verify  {"id_token": "...", "state": "..."}  -> {"email": "...", ...}
+//
+// Errors are returned as {"error": "...", "code": "..."}, where code is one of
+// the values listed in errorCodes.
+//
+// If the PORTIER_REST_TOKEN environment variable is set, requests must carry
+// it as a bearer token in the Authorization header.
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/portier/portier-go"
+)
+
+type authRequest struct {
+	Email string `json:"email"`
+	State string `json:"state,omitempty"`
+}
+
+type authResponse struct {
+	URL string `json:"url"`
+}
+
+type verifyRequest struct {
+	IDToken          string `json:"id_token"`
+	State            string `json:"state,omitempty"`
+	Error            string `json:"error,omitempty"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+type verifyResponse struct {
+	Email         string    `json:"email"`
+	EmailOriginal string    `json:"email_original"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	IssuedAt      time.Time `json:"issued_at"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+// errorCodes maps errors to the code field in error responses.
+var errorCodes = []struct {
+	err    error
+	code   string
+	status int
+}{
+	{portier.ErrBrokerUnreachable, "broker_unreachable", http.StatusBadGateway},
+	{portier.ErrBrokerUnavailable, "broker_unavailable", http.StatusServiceUnavailable},
+	{portier.ErrRateLimited, "rate_limited", http.StatusTooManyRequests},
+	{portier.ErrInvalidEmail, "invalid_email", http.StatusBadRequest},
+	{portier.ErrEmailNotAllowed, "email_not_allowed", http.StatusForbidden},
+	{portier.ErrInvalidSession, "invalid_session", http.StatusBadRequest},
+	{portier.ErrTokenExpired, "token_expired", http.StatusBadRequest},
+	{portier.ErrTokenNotYetValid, "token_not_yet_valid", http.StatusBadRequest},
+	{portier.ErrInvalidSignature, "invalid_signature", http.StatusBadRequest},
+	{portier.ErrUnknownKey, "unknown_key", http.StatusBadRequest},
+	{portier.ErrInvalidAudience, "invalid_audience", http.StatusBadRequest},
+	{portier.ErrInvalidIssuer, "invalid_issuer", http.StatusBadRequest},
+	{portier.ErrInvalidToken, "invalid_token", http.StatusBadRequest},
+}
+
+func main() {
+	listen := flag.String("listen", ":8080", "address to listen on")
+	broker := flag.String("broker", portier.DefaultBroker, "origin of the Portier broker")
+	redirectURI := flag.String("redirect-uri", "", "redirect URI of the application (required)")
+	flag.Parse()
+
+	if *redirectURI == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	client, err := portier.NewClient(&portier.Config{
+		Broker:      *broker,
+		RedirectURI: *redirectURI,
+	})
+	if err != nil {
+		log.Fatal("portier.NewClient error:", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth", func(w http.ResponseWriter, r *http.Request) {
+		var req authRequest
+		if !decodeRequest(w, r, &req) {
+			return
+		}
+
+		var options []portier.AuthOption
+		if req.State != "" {
+			options = append(options, portier.WithState(req.State))
+		}
+		authURL, err := client.StartAuth(req.Email, options...)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, &authResponse{authURL})
+	})
+	mux.HandleFunc("/verify", func(w http.ResponseWriter, r *http.Request) {
+		var req verifyRequest
+		if !decodeRequest(w, r, &req) {
+			return
+		}
+
+		params := make(url.Values)
+		for name, value := range map[string]string{
+			"id_token":          req.IDToken,
+			"state":             req.State,
+			"error":             req.Error,
+			"error_description": req.ErrorDescription,
+		} {
+			if value != "" {
+				params.Set(name, value)
+			}
+		}
+
+		result, err := client.VerifyCallback(params)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, &verifyResponse{
+			Email:         result.Email,
+			EmailOriginal: result.EmailOriginal,
+			ExpiresAt:     result.ExpiresAt,
+			IssuedAt:      result.IssuedAt,
+		})
+	})
+
+	handler := http.Handler(mux)
+	if token := os.Getenv("PORTIER_REST_TOKEN"); token != "" {
+		handler = requireToken(token, handler)
+	}
+
+	log.Printf("listening on %s", *listen)
+	log.Fatal(http.ListenAndServe(*listen, handler))
+}
+
+func requireToken(token string, next http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actual := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(actual, expected) != 1 {
+			writeJSON(w, http.StatusUnauthorized, &errorResponse{"unauthorized", "unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func decodeRequest(w http.ResponseWriter, r *http.Request, req interface{}) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, &errorResponse{"method not allowed", "bad_request"})
+		return false
+	}
+
+	body := http.MaxBytesReader(w, r.Body, 64*1024)
+	if err := json.NewDecoder(body).Decode(req); err != nil {
+		writeJSON(w, http.StatusBadRequest, &errorResponse{err.Error(), "bad_request"})
+		return false
+	}
+	return true
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	var brokerErr *portier.BrokerError
+	if errors.As(err, &brokerErr) {
+		writeJSON(w, http.StatusBadRequest, &errorResponse{err.Error(), brokerErr.Code})
+		return
+	}
+
+	for _, entry := range errorCodes {
+		if errors.Is(err, entry.err) {
+			writeJSON(w, entry.status, &errorResponse{err.Error(), entry.code})
+			return
+		}
+	}
+
+	log.Print("request error:", err)
+	writeJSON(w, http.StatusInternalServerError, &errorResponse{"internal error", "internal"})
+}
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
@@ -0,0 +1,194 @@
+package portier
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+)
+
+// configJSON is the model used for JSON encoding of Config. Fields that can't
+// be represented in JSON, like Store and the function fields, are omitted.
+type configJSON struct {
+	Broker               string                   `json:"broker,omitempty"`
+	FallbackBrokers      []string                 `json:"fallback_brokers,omitempty"`
+	RedirectURI          string                   `json:"redirect_uri,omitempty"`
+	ResponseMode         string                   `json:"response_mode,omitempty"`
+	Leeway               jsonDuration             `json:"leeway,omitempty"`
+	MaxTokenSize         int                      `json:"max_token_size,omitempty"`
+	Scopes               []string                 `json:"scopes,omitempty"`
+	ExpLeeway            jsonDuration             `json:"exp_leeway,omitempty"`
+	NbfLeeway            jsonDuration             `json:"nbf_leeway,omitempty"`
+	IatLeeway            jsonDuration             `json:"iat_leeway,omitempty"`
+	SessionTTL           jsonDuration             `json:"session_ttl,omitempty"`
+	RetryWindow          jsonDuration             `json:"retry_window,omitempty"`
+	KeyCacheTTL          jsonDuration             `json:"key_cache_ttl,omitempty"`
+	BreakerThreshold     int                      `json:"breaker_threshold,omitempty"`
+	BreakerCooldown      jsonDuration             `json:"breaker_cooldown,omitempty"`
+	CheckTokenID         bool                     `json:"check_token_id,omitempty"`
+	AllowedAlgorithms    []jwa.SignatureAlgorithm `json:"allowed_algorithms,omitempty"`
+	PinnedKeys           []string                 `json:"pinned_keys,omitempty"`
+	AdditionalAudiences  []string                 `json:"additional_audiences,omitempty"`
+	StrictAudience       bool                     `json:"strict_audience,omitempty"`
+	CheckEmailVerified   bool                     `json:"check_email_verified,omitempty"`
+	RequireEmailVerified bool                     `json:"require_email_verified,omitempty"`
+	RequiredClaims       map[string]interface{}   `json:"required_claims,omitempty"`
+	ForbiddenClaims      []string                 `json:"forbidden_claims,omitempty"`
+	AllowedDomains       []string                 `json:"allowed_domains,omitempty"`
+	DeniedDomains        []string                 `json:"denied_domains,omitempty"`
+	RequireHTTPS         bool                     `json:"require_https,omitempty"`
+	MinCacheAge          jsonDuration             `json:"min_cache_age,omitempty"`
+	MaxCacheAge          jsonDuration             `json:"max_cache_age,omitempty"`
+	BrokerHeaders        http.Header              `json:"broker_headers,omitempty"`
+}
+
+// jsonDuration is a time.Duration encoded in JSON as a string like "3m".
+type jsonDuration time.Duration
+
+func (d jsonDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *jsonDuration) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("duration must be a string like \"3m\": %w", err)
+	}
+	parsed, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+	*d = jsonDuration(parsed)
+	return nil
+}
+
+// MarshalJSON encodes the Config as JSON, with snake_case keys and durations
+// as strings like "3m". Fields that can't be represented in JSON, like Store,
+// Clock, HTTPClient, TLSConfig and the function fields, are omitted.
+// BrokerHeaders is omitted as well, because it typically holds credentials
+// that should not end up in dumped or logged configs.
+//
+// YAML is supported through libraries that convert YAML to JSON, such as
+// sigs.k8s.io/yaml.
+func (cfg Config) MarshalJSON() ([]byte, error) {
+	return json.Marshal(configJSON{
+		Broker:               cfg.Broker,
+		FallbackBrokers:      cfg.FallbackBrokers,
+		RedirectURI:          cfg.RedirectURI,
+		ResponseMode:         cfg.ResponseMode,
+		Leeway:               jsonDuration(cfg.Leeway),
+		MaxTokenSize:         cfg.MaxTokenSize,
+		Scopes:               cfg.Scopes,
+		ExpLeeway:            jsonDuration(cfg.ExpLeeway),
+		NbfLeeway:            jsonDuration(cfg.NbfLeeway),
+		IatLeeway:            jsonDuration(cfg.IatLeeway),
+		SessionTTL:           jsonDuration(cfg.SessionTTL),
+		RetryWindow:          jsonDuration(cfg.RetryWindow),
+		KeyCacheTTL:          jsonDuration(cfg.KeyCacheTTL),
+		BreakerThreshold:     cfg.BreakerThreshold,
+		BreakerCooldown:      jsonDuration(cfg.BreakerCooldown),
+		CheckTokenID:         cfg.CheckTokenID,
+		AllowedAlgorithms:    cfg.AllowedAlgorithms,
+		PinnedKeys:           cfg.PinnedKeys,
+		AdditionalAudiences:  cfg.AdditionalAudiences,
+		StrictAudience:       cfg.StrictAudience,
+		CheckEmailVerified:   cfg.CheckEmailVerified,
+		RequireEmailVerified: cfg.RequireEmailVerified,
+		RequiredClaims:       cfg.RequiredClaims,
+		ForbiddenClaims:      cfg.ForbiddenClaims,
+		AllowedDomains:       cfg.AllowedDomains,
+		DeniedDomains:        cfg.DeniedDomains,
+		RequireHTTPS:         cfg.RequireHTTPS,
+		MinCacheAge:          jsonDuration(cfg.MinCacheAge),
+		MaxCacheAge:          jsonDuration(cfg.MaxCacheAge),
+	})
+}
+
+// UnmarshalJSON decodes JSON produced by MarshalJSON into the Config. Fields
+// not represented in JSON are left unchanged, so they can be set before or
+// after decoding. Unknown keys are an error, to catch typos. BrokerHeaders
+// is decoded from "broker_headers", even though MarshalJSON omits it.
+func (cfg *Config) UnmarshalJSON(data []byte) error {
+	var decoded configJSON
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&decoded); err != nil {
+		return err
+	}
+
+	cfg.Broker = decoded.Broker
+	cfg.FallbackBrokers = decoded.FallbackBrokers
+	cfg.RedirectURI = decoded.RedirectURI
+	cfg.ResponseMode = decoded.ResponseMode
+	cfg.Leeway = time.Duration(decoded.Leeway)
+	cfg.MaxTokenSize = decoded.MaxTokenSize
+	cfg.Scopes = decoded.Scopes
+	cfg.ExpLeeway = time.Duration(decoded.ExpLeeway)
+	cfg.NbfLeeway = time.Duration(decoded.NbfLeeway)
+	cfg.IatLeeway = time.Duration(decoded.IatLeeway)
+	cfg.SessionTTL = time.Duration(decoded.SessionTTL)
+	cfg.RetryWindow = time.Duration(decoded.RetryWindow)
+	cfg.KeyCacheTTL = time.Duration(decoded.KeyCacheTTL)
+	cfg.BreakerThreshold = decoded.BreakerThreshold
+	cfg.BreakerCooldown = time.Duration(decoded.BreakerCooldown)
+	cfg.CheckTokenID = decoded.CheckTokenID
+	cfg.AllowedAlgorithms = decoded.AllowedAlgorithms
+	cfg.PinnedKeys = decoded.PinnedKeys
+	cfg.AdditionalAudiences = decoded.AdditionalAudiences
+	cfg.StrictAudience = decoded.StrictAudience
+	cfg.CheckEmailVerified = decoded.CheckEmailVerified
+	cfg.RequireEmailVerified = decoded.RequireEmailVerified
+	cfg.RequiredClaims = decoded.RequiredClaims
+	cfg.ForbiddenClaims = decoded.ForbiddenClaims
+	cfg.AllowedDomains = decoded.AllowedDomains
+	cfg.DeniedDomains = decoded.DeniedDomains
+	cfg.RequireHTTPS = decoded.RequireHTTPS
+	cfg.MinCacheAge = time.Duration(decoded.MinCacheAge)
+	cfg.MaxCacheAge = time.Duration(decoded.MaxCacheAge)
+	cfg.BrokerHeaders = decoded.BrokerHeaders
+	return nil
+}
+
+// LoadConfigs reads a JSON object mapping names, typically hosts, to Configs,
+// as encoded by Config.MarshalJSON. The result can be used with ConfigMap to
+// create a ClientPool. The names are lowercased, like the hosts in a
+// ClientPool, and names that differ only in case are an error.
+func LoadConfigs(r io.Reader) (map[string]*Config, error) {
+	var decoded map[string]*Config
+	if err := json.NewDecoder(r).Decode(&decoded); err != nil {
+		return nil, fmt.Errorf("could not decode configs: %w", err)
+	}
+	configs := make(map[string]*Config, len(decoded))
+	for name, cfg := range decoded {
+		lower := strings.ToLower(name)
+		if _, ok := configs[lower]; ok {
+			return nil, fmt.Errorf("duplicate config name: %s", lower)
+		}
+		configs[lower] = cfg
+	}
+	return configs, nil
+}
+
+// ConfigMap returns a ConfigFunc for NewClientPool that looks up the host in
+// the map, and returns an error for unknown hosts. Hosts are matched case
+// insensitively. The Configs are copied, so the map can be shared by multiple
+// pools.
+func ConfigMap(configs map[string]*Config) ConfigFunc {
+	lowered := make(map[string]*Config, len(configs))
+	for name, cfg := range configs {
+		lowered[strings.ToLower(name)] = cfg
+	}
+	return func(host string) (*Config, error) {
+		cfg, ok := lowered[strings.ToLower(host)]
+		if !ok || cfg == nil {
+			return nil, fmt.Errorf("no configuration for host: %s", host)
+		}
+		copied := *cfg
+		return &copied, nil
+	}
+}
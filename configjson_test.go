@@ -0,0 +1,57 @@
+package portier
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestConfigMarshalJSONOmitsBrokerHeaders(t *testing.T) {
+	cfg := &Config{
+		Broker:        "https://broker.test",
+		BrokerHeaders: http.Header{"Authorization": {"Bearer secret"}},
+	}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("secret")) {
+		t.Errorf("BrokerHeaders was encoded: %s", data)
+	}
+
+	// BrokerHeaders can still be set from JSON.
+	var decoded Config
+	if err := json.Unmarshal([]byte(`{"broker_headers":{"Authorization":["Bearer secret"]}}`), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if got := decoded.BrokerHeaders.Get("Authorization"); got != "Bearer secret" {
+		t.Errorf("unexpected Authorization header: %q", got)
+	}
+}
+
+func TestLoadConfigsLowercasesNames(t *testing.T) {
+	configs, err := LoadConfigs(strings.NewReader(`{"App.Example.com": {"broker": "https://broker.test"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := ConfigMap(configs)("app.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Broker != "https://broker.test" {
+		t.Errorf("unexpected broker: %s", cfg.Broker)
+	}
+
+	if _, err := LoadConfigs(strings.NewReader(`{"a.test": {}, "A.test": {}}`)); err == nil {
+		t.Error("LoadConfigs accepted names that differ only in case")
+	}
+}
+
+func TestConfigMapIgnoresCase(t *testing.T) {
+	configs := map[string]*Config{"App.Example.com": {Broker: "https://broker.test"}}
+	if _, err := ConfigMap(configs)("app.example.COM"); err != nil {
+		t.Error(err)
+	}
+}
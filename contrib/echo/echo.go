@@ -0,0 +1,83 @@
+// Package portierecho provides Echo bindings for Portier authentication,
+// built on top of the handlers in portierhttp.
+//
+// A typical setup looks like:
+//
+//	portierecho.Register(e, client, session, "/login", "/verify")
+//
+//	private := e.Group("", portierecho.RequireLogin(session, "/login"))
+//	private.GET("/", func(c echo.Context) error {
+//		email, _ := portierecho.Email(c)
+//		return c.String(http.StatusOK, "Hello, "+email)
+//	})
+package portierecho
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/portier/portier-go"
+	"github.com/portier/portier-go/portierhttp"
+)
+
+// EmailKey is the Echo context key RequireLogin stores the verified email
+// address under.
+const EmailKey = "portier.email"
+
+// Router is implemented by both *echo.Echo and *echo.Group.
+type Router interface {
+	POST(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route
+}
+
+// Register adds the Login handler on loginPath, and the Callback handler on
+// callbackPath, which should be the path of the RedirectURI of the client.
+func Register(router Router, client portier.Client, session portierhttp.SessionBackend, loginPath, callbackPath string) {
+	router.POST(loginPath, Login(client))
+	router.POST(callbackPath, Callback(client, session))
+}
+
+// Login returns a handler that starts authentication. See
+// portierhttp.LoginHandler.
+func Login(client portier.Client) echo.HandlerFunc {
+	return echo.WrapHandler(&portierhttp.LoginHandler{Client: client})
+}
+
+// Callback returns a handler for the RedirectURI of the client, which stores
+// the verified email address in the session. See portierhttp.CallbackHandler
+// and portierhttp.LoginSuccess.
+func Callback(client portier.Client, session portierhttp.SessionBackend) echo.HandlerFunc {
+	return echo.WrapHandler(&portierhttp.CallbackHandler{
+		Client:  client,
+		Success: portierhttp.LoginSuccess(session),
+	})
+}
+
+// RequireLogin returns middleware that only allows requests with a valid
+// session to pass, and redirects other requests to loginURL. See
+// portierhttp.RequireLogin.
+//
+// The verified email address is available via Email, c.Get(EmailKey), and
+// portierhttp.EmailFromContext on the request context.
+func RequireLogin(session portierhttp.SessionBackend, loginURL string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			r := c.Request()
+			email, err := session.Get(r)
+			if err != nil {
+				return err
+			}
+			if email == "" {
+				portierhttp.RedirectToLogin(c.Response(), r, loginURL)
+				return nil
+			}
+
+			c.Set(EmailKey, email)
+			c.SetRequest(r.WithContext(portierhttp.WithEmail(r.Context(), email)))
+			return next(c)
+		}
+	}
+}
+
+// Email returns the verified email address stored by RequireLogin.
+func Email(c echo.Context) (string, bool) {
+	email, ok := c.Get(EmailKey).(string)
+	return email, ok && email != ""
+}
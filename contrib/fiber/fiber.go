@@ -0,0 +1,80 @@
+// Package portierfiber provides Fiber bindings for Portier authentication.
+//
+// Fiber is not based on net/http, so the login and callback handlers are
+// adapted from portierhttp, while RequireLogin is implemented natively.
+//
+// A typical setup looks like:
+//
+//	app.Post("/login", portierfiber.Login(client))
+//	app.Post("/verify", portierfiber.Callback(client, session))
+//
+//	private := app.Group("/", portierfiber.RequireLogin(session, "/login"))
+//	private.Get("/", func(c *fiber.Ctx) error {
+//		email, _ := portierfiber.Email(c)
+//		return c.SendString("Hello, " + email)
+//	})
+package portierfiber
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/portier/portier-go"
+	"github.com/portier/portier-go/portierhttp"
+)
+
+// EmailKey is the Fiber locals key RequireLogin stores the verified email
+// address under.
+const EmailKey = "portier.email"
+
+// Login returns a handler that starts authentication. See
+// portierhttp.LoginHandler.
+func Login(client portier.Client) fiber.Handler {
+	return adaptor.HTTPHandler(&portierhttp.LoginHandler{Client: client})
+}
+
+// Callback returns a handler for the RedirectURI of the client, which stores
+// the verified email address in the session. See portierhttp.CallbackHandler
+// and portierhttp.LoginSuccess.
+func Callback(client portier.Client, session portierhttp.SessionBackend) fiber.Handler {
+	return adaptor.HTTPHandler(&portierhttp.CallbackHandler{
+		Client:  client,
+		Success: portierhttp.LoginSuccess(session),
+	})
+}
+
+// RequireLogin returns middleware that only allows requests with a valid
+// session to pass, and redirects other requests to loginURL. See
+// portierhttp.RequireLogin.
+//
+// The verified email address is available via Email, c.Locals(EmailKey), and
+// portierhttp.EmailFromContext on c.UserContext().
+func RequireLogin(session portierhttp.SessionBackend, loginURL string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		r, err := adaptor.ConvertRequest(c, false)
+		if err != nil {
+			return err
+		}
+
+		email, err := session.Get(r)
+		if err != nil {
+			return err
+		}
+		if email == "" {
+			target, err := portierhttp.LoginURL(loginURL, c.OriginalURL())
+			if err != nil {
+				return err
+			}
+			return c.Redirect(target, fiber.StatusSeeOther)
+		}
+
+		c.Locals(EmailKey, email)
+		c.SetUserContext(portierhttp.WithEmail(c.UserContext(), email))
+		return c.Next()
+	}
+}
+
+// Email returns the verified email address stored by RequireLogin.
+func Email(c *fiber.Ctx) (string, bool) {
+	email, ok := c.Locals(EmailKey).(string)
+	return email, ok && email != ""
+}
@@ -0,0 +1,73 @@
+// Package portiergin provides Gin bindings for Portier authentication, built
+// on top of the handlers in portierhttp.
+//
+// A typical setup looks like:
+//
+//	router.POST("/login", portiergin.Login(client))
+//	router.POST("/verify", portiergin.Callback(client, session))
+//
+//	private := router.Group("/", portiergin.RequireLogin(session, "/login"))
+//	private.GET("/", func(c *gin.Context) {
+//		email, _ := portiergin.Email(c)
+//		c.String(http.StatusOK, "Hello, %s", email)
+//	})
+package portiergin
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/portier/portier-go"
+	"github.com/portier/portier-go/portierhttp"
+)
+
+// EmailKey is the Gin context key RequireLogin stores the verified email
+// address under.
+const EmailKey = "portier.email"
+
+// Login returns a handler that starts authentication. See
+// portierhttp.LoginHandler.
+func Login(client portier.Client) gin.HandlerFunc {
+	return gin.WrapH(&portierhttp.LoginHandler{Client: client})
+}
+
+// Callback returns a handler for the RedirectURI of the client, which stores
+// the verified email address in the session. See portierhttp.CallbackHandler
+// and portierhttp.LoginSuccess.
+func Callback(client portier.Client, session portierhttp.SessionBackend) gin.HandlerFunc {
+	return gin.WrapH(&portierhttp.CallbackHandler{
+		Client:  client,
+		Success: portierhttp.LoginSuccess(session),
+	})
+}
+
+// RequireLogin returns middleware that only allows requests with a valid
+// session to pass, and redirects other requests to loginURL. See
+// portierhttp.RequireLogin.
+//
+// The verified email address is available via Email, c.Get(EmailKey), and
+// portierhttp.EmailFromContext on the request context.
+func RequireLogin(session portierhttp.SessionBackend, loginURL string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		email, err := session.Get(c.Request)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		if email == "" {
+			portierhttp.RedirectToLogin(c.Writer, c.Request, loginURL)
+			c.Abort()
+			return
+		}
+
+		c.Set(EmailKey, email)
+		c.Request = c.Request.WithContext(portierhttp.WithEmail(c.Request.Context(), email))
+		c.Next()
+	}
+}
+
+// Email returns the verified email address stored by RequireLogin.
+func Email(c *gin.Context) (string, bool) {
+	email := c.GetString(EmailKey)
+	return email, email != ""
+}
@@ -0,0 +1,89 @@
+// Package portiergorilla stores the identity verified by a portier.Client in
+// a gorilla/sessions session.
+package portiergorilla
+
+import (
+	"net/http"
+
+	"github.com/gorilla/sessions"
+	"github.com/portier/portier-go"
+	"github.com/portier/portier-go/portierhttp"
+)
+
+// EmailKey is the session value key used to store the verified email address.
+const EmailKey = "portier.email"
+
+// Login stores the verified email address from result in the session, and
+// saves the session.
+func Login(w http.ResponseWriter, r *http.Request, session *sessions.Session, result *portier.VerifyResult) error {
+	session.Values[EmailKey] = result.Email
+	return session.Save(r, w)
+}
+
+// Logout removes the verified email address from the session, and saves the
+// session.
+func Logout(w http.ResponseWriter, r *http.Request, session *sessions.Session) error {
+	delete(session.Values, EmailKey)
+	return session.Save(r, w)
+}
+
+// Email returns the verified email address stored in the session by Login.
+func Email(session *sessions.Session) (string, bool) {
+	email, ok := session.Values[EmailKey].(string)
+	return email, ok && email != ""
+}
+
+// LoginSuccess returns a SuccessFunc for portierhttp.CallbackHandler that
+// stores the verified email address in the named session, and redirects to
+// portierhttp.NextURL.
+func LoginSuccess(store sessions.Store, name string) portierhttp.SuccessFunc {
+	return func(w http.ResponseWriter, r *http.Request, result *portier.VerifyResult) {
+		session, err := store.Get(r, name)
+		if err != nil && session == nil {
+			http.Error(w, "Session error", http.StatusInternalServerError)
+			return
+		}
+		if err := Login(w, r, session, result); err != nil {
+			http.Error(w, "Session error", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, portierhttp.NextURL(result), http.StatusSeeOther)
+	}
+}
+
+// Backend is a portierhttp.SessionBackend that stores the verified email
+// address in a gorilla/sessions session, so it can be used with
+// portierhttp.RequireLogin and portierhttp.LoginFlow.
+type Backend struct {
+	Store sessions.Store
+	Name  string // Session name
+}
+
+// Get returns the verified email address stored in the session.
+func (b *Backend) Get(r *http.Request) (string, error) {
+	session, err := b.Store.Get(r, b.Name)
+	if err != nil && session == nil {
+		return "", err
+	}
+	email, _ := Email(session)
+	return email, nil
+}
+
+// Set stores the verified email address in the session.
+func (b *Backend) Set(w http.ResponseWriter, r *http.Request, email string) error {
+	session, err := b.Store.Get(r, b.Name)
+	if err != nil && session == nil {
+		return err
+	}
+	session.Values[EmailKey] = email
+	return session.Save(r, w)
+}
+
+// Clear removes the verified email address from the session.
+func (b *Backend) Clear(w http.ResponseWriter, r *http.Request) error {
+	session, err := b.Store.Get(r, b.Name)
+	if err != nil && session == nil {
+		return err
+	}
+	return Logout(w, r, session)
+}
@@ -0,0 +1,9 @@
+// Package portierpb contains the generated protobuf and gRPC code for the
+// Portier service.
+package portierpb
+
+// The code is generated with protoc-gen-go v1.34.2 and protoc-gen-go-grpc
+// v1.4.0, which match the protobuf and grpc versions required in go.mod.
+// Upgrade the generators and the requirements together.
+//
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative portier.proto
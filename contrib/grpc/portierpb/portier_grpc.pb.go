@@ -0,0 +1,160 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.4.0
+// - protoc             (unknown)
+// source: portier.proto
+
+package portierpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.62.0 or later.
+const _ = grpc.SupportPackageIsVersion8
+
+const (
+	Portier_StartAuth_FullMethodName = "/portier.v1.Portier/StartAuth"
+	Portier_Verify_FullMethodName    = "/portier.v1.Portier/Verify"
+)
+
+// PortierClient is the client API for Portier service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Portier exposes a Portier client, so services can delegate authentication
+// to a central auth service.
+type PortierClient interface {
+	// StartAuth creates a login session, and returns the URL to redirect the
+	// user agent to.
+	StartAuth(ctx context.Context, in *StartAuthRequest, opts ...grpc.CallOption) (*StartAuthResponse, error)
+	// Verify verifies the parameters sent by the broker to the redirect URI.
+	Verify(ctx context.Context, in *VerifyRequest, opts ...grpc.CallOption) (*VerifyResponse, error)
+}
+
+type portierClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewPortierClient(cc grpc.ClientConnInterface) PortierClient {
+	return &portierClient{cc}
+}
+
+func (c *portierClient) StartAuth(ctx context.Context, in *StartAuthRequest, opts ...grpc.CallOption) (*StartAuthResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(StartAuthResponse)
+	err := c.cc.Invoke(ctx, Portier_StartAuth_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *portierClient) Verify(ctx context.Context, in *VerifyRequest, opts ...grpc.CallOption) (*VerifyResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(VerifyResponse)
+	err := c.cc.Invoke(ctx, Portier_Verify_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PortierServer is the server API for Portier service.
+// All implementations must embed UnimplementedPortierServer
+// for forward compatibility
+//
+// Portier exposes a Portier client, so services can delegate authentication
+// to a central auth service.
+type PortierServer interface {
+	// StartAuth creates a login session, and returns the URL to redirect the
+	// user agent to.
+	StartAuth(context.Context, *StartAuthRequest) (*StartAuthResponse, error)
+	// Verify verifies the parameters sent by the broker to the redirect URI.
+	Verify(context.Context, *VerifyRequest) (*VerifyResponse, error)
+	mustEmbedUnimplementedPortierServer()
+}
+
+// UnimplementedPortierServer must be embedded to have forward compatible implementations.
+type UnimplementedPortierServer struct {
+}
+
+func (UnimplementedPortierServer) StartAuth(context.Context, *StartAuthRequest) (*StartAuthResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method StartAuth not implemented")
+}
+func (UnimplementedPortierServer) Verify(context.Context, *VerifyRequest) (*VerifyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Verify not implemented")
+}
+func (UnimplementedPortierServer) mustEmbedUnimplementedPortierServer() {}
+
+// UnsafePortierServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to PortierServer will
+// result in compilation errors.
+type UnsafePortierServer interface {
+	mustEmbedUnimplementedPortierServer()
+}
+
+func RegisterPortierServer(s grpc.ServiceRegistrar, srv PortierServer) {
+	s.RegisterService(&Portier_ServiceDesc, srv)
+}
+
+func _Portier_StartAuth_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StartAuthRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PortierServer).StartAuth(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Portier_StartAuth_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PortierServer).StartAuth(ctx, req.(*StartAuthRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Portier_Verify_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(VerifyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PortierServer).Verify(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Portier_Verify_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PortierServer).Verify(ctx, req.(*VerifyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Portier_ServiceDesc is the grpc.ServiceDesc for Portier service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Portier_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "portier.v1.Portier",
+	HandlerType: (*PortierServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "StartAuth",
+			Handler:    _Portier_StartAuth_Handler,
+		},
+		{
+			MethodName: "Verify",
+			Handler:    _Portier_Verify_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "portier.proto",
+}
@@ -0,0 +1,109 @@
+// Package portiergrpc exposes a portier.Client as a gRPC service, so
+// microservice architectures can centralize Portier handling in one auth
+// service. The service is defined in portierpb/portier.proto.
+//
+// A typical server looks like:
+//
+//	server := grpc.NewServer()
+//	portierpb.RegisterPortierServer(server, portiergrpc.NewServer(client))
+//	server.Serve(listener)
+package portiergrpc
+
+import (
+	"context"
+	"errors"
+	"net/url"
+
+	"github.com/portier/portier-go"
+	"github.com/portier/portier-go/contrib/grpc/portierpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type server struct {
+	portierpb.UnimplementedPortierServer
+	client portier.Client
+}
+
+// NewServer returns a portierpb.PortierServer backed by the client.
+//
+// Errors are mapped to gRPC status codes: broker errors from the callback
+// become FailedPrecondition, failure to reach the broker becomes Unavailable,
+// other verification failures become Unauthenticated.
+func NewServer(client portier.Client) portierpb.PortierServer {
+	return &server{client: client}
+}
+
+func (s *server) StartAuth(ctx context.Context, req *portierpb.StartAuthRequest) (*portierpb.StartAuthResponse, error) {
+	var options []portier.AuthOption
+	if req.State != "" {
+		options = append(options, portier.WithState(req.State))
+	}
+	if req.Data != "" {
+		options = append(options, portier.WithData(req.Data))
+	}
+
+	authURL, err := s.client.StartAuth(req.Email, options...)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &portierpb.StartAuthResponse{Url: authURL}, nil
+}
+
+func (s *server) Verify(ctx context.Context, req *portierpb.VerifyRequest) (*portierpb.VerifyResponse, error) {
+	params := make(url.Values)
+	for name, value := range map[string]string{
+		"id_token":          req.IdToken,
+		"state":             req.State,
+		"error":             req.Error,
+		"error_description": req.ErrorDescription,
+	} {
+		if value != "" {
+			params.Set(name, value)
+		}
+	}
+
+	result, err := s.client.VerifyCallback(params)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &portierpb.VerifyResponse{
+		Email:         result.Email,
+		EmailOriginal: result.EmailOriginal,
+		ExpiresAt:     timestamppb.New(result.ExpiresAt),
+		IssuedAt:      timestamppb.New(result.IssuedAt),
+		State:         result.State,
+		Data:          result.Data,
+	}, nil
+}
+
+func toStatus(err error) error {
+	var brokerErr *portier.BrokerError
+	switch {
+	case errors.As(err, &brokerErr):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, portier.ErrBrokerUnreachable),
+		errors.Is(err, portier.ErrBrokerUnavailable):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, portier.ErrInvalidEmail):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, portier.ErrEmailNotAllowed):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, portier.ErrRateLimited):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, portier.ErrInvalidToken),
+		errors.Is(err, portier.ErrInvalidSignature),
+		errors.Is(err, portier.ErrUnknownKey),
+		errors.Is(err, portier.ErrTokenExpired),
+		errors.Is(err, portier.ErrTokenNotYetValid),
+		errors.Is(err, portier.ErrInvalidAudience),
+		errors.Is(err, portier.ErrInvalidIssuer),
+		errors.Is(err, portier.ErrInvalidSession):
+		return status.Error(codes.Unauthenticated, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
@@ -11,6 +11,9 @@
 // Contributions are welcome!)
 //
 // Some applications may need more than a single Client / Config, for example
-// because they serve multiple domains. In this case, we recommended creating
-// short-lived Clients and sharing the Store between them.
+// because they serve multiple domains. In this case, a ClientPool can create
+// and cache a Client per domain, sharing the Store between them. (If a single
+// domain is simply served under several hostnames, see
+// Config.AdditionalAudiences instead.) Per-domain settings can be kept in a
+// configuration file, see LoadConfigs and ConfigMap.
 package portier
@@ -0,0 +1,128 @@
+package portier
+
+import (
+	"net"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
+)
+
+// maxEmailLength is the maximum length of an email address, per RFC 5321.
+const maxEmailLength = 254
+
+// NormalizeEmail normalizes an email address the way Portier brokers do
+// before asserting it in a token: the local part is lowercased, using full
+// Unicode case mapping, and the domain is converted to its ASCII form, using IDNA
+// (punycode) for internationalized domains, without a trailing dot. The
+// result can be used as a key in a user database, consistent with
+// VerifyResult.Email.
+//
+// An error matching ErrInvalidEmail is returned if the address is not valid.
+func NormalizeEmail(email string) (string, error) {
+	if err := validateEmail(email); err != nil {
+		return "", err
+	}
+
+	local, domain := splitEmail(email)
+	ascii, err := idna.Lookup.ToASCII(strings.TrimSuffix(domain, "."))
+	if err != nil {
+		return "", newError(ErrInvalidEmail, "email address has an invalid domain: %w", err)
+	}
+	return cases.Lower(language.Und).String(local) + "@" + ascii, nil
+}
+
+// UnicodeEmail converts the domain of an email address to its Unicode form,
+// for display. This reverses the punycode conversion of internationalized
+// domains done by NormalizeEmail and the broker. A trailing dot is removed
+// from the domain, and the local part is unchanged.
+func UnicodeEmail(email string) (string, error) {
+	local, domain := splitEmail(email)
+	unicode, err := idna.Lookup.ToUnicode(strings.TrimSuffix(domain, "."))
+	if err != nil {
+		return "", newError(ErrInvalidEmail, "email address has an invalid domain: %w", err)
+	}
+	return local + "@" + unicode, nil
+}
+
+// pairingEmail returns the form of an email address used to pair it with a
+// nonce in the Store. The domain is converted to ASCII, so that the pairing
+// does not depend on how the broker represents internationalized domains in
+// the email_original claim, or on a trailing dot. If conversion fails, the
+// address is unchanged.
+func pairingEmail(email string) string {
+	local, domain := splitEmail(email)
+	ascii, err := idna.Lookup.ToASCII(strings.TrimSuffix(domain, "."))
+	if err != nil || ascii == "" {
+		return email
+	}
+	return local + "@" + ascii
+}
+
+// splitEmail splits an email address at the last '@'. If there is none, the
+// domain is empty.
+func splitEmail(email string) (string, string) {
+	i := strings.LastIndexByte(email, '@')
+	if i < 0 {
+		return email, ""
+	}
+	return email[:i], email[i+1:]
+}
+
+// validateEmail checks an email address against the relaxed syntax accepted
+// by Portier brokers: a non-empty local part, and a domain name, separated by
+// the last '@'. IP address literals are not accepted as the domain. It does
+// not attempt full RFC 5322 validation.
+func validateEmail(email string) error {
+	if len(email) > maxEmailLength {
+		return newError(ErrInvalidEmail, "email address too long")
+	}
+	for _, r := range email {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return newError(ErrInvalidEmail, "email address contains whitespace or control characters")
+		}
+	}
+
+	if !strings.Contains(email, "@") {
+		return newError(ErrInvalidEmail, "email address is missing '@'")
+	}
+	local, domain := splitEmail(email)
+	if local == "" {
+		return newError(ErrInvalidEmail, "email address has an empty local part")
+	}
+	if !validDomain(domain) || net.ParseIP(domain) != nil {
+		return newError(ErrInvalidEmail, "email address has an invalid domain: %s", domain)
+	}
+	if _, err := idna.Lookup.ToASCII(domain); err != nil {
+		return newError(ErrInvalidEmail, "email address has an invalid domain: %w", err)
+	}
+
+	return nil
+}
+
+// validDomain checks whether the domain of an email address is a valid host
+// name. Non-ASCII labels are allowed, for internationalized domain names.
+func validDomain(domain string) bool {
+	domain = strings.TrimSuffix(domain, ".")
+	if domain == "" {
+		return false
+	}
+
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if r < 0x80 && r != '-' && !('a' <= r && r <= 'z') && !('A' <= r && r <= 'Z') && !('0' <= r && r <= '9') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
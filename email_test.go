@@ -0,0 +1,145 @@
+package portier
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// normalizeTests are the normalization test vectors from the Portier
+// specification. An empty result means the input is invalid.
+var normalizeTests = []struct {
+	email string
+	want  string
+}{
+	// Valid
+	{"example.foo+bar@example.com", "example.foo+bar@example.com"},
+	{"EXAMPLE.FOO+BAR@EXAMPLE.COM", "example.foo+bar@example.com"},
+	// Simple case transformation
+	{"BJÖRN@göteborg.test", "björn@xn--gteborg-90a.test"},
+	// Special case transformation
+	{"İⅢ@İⅢ.example", "i̇ⅲ@xn--iiii-qwc.example"},
+	// Invalid
+	{"foo", ""},
+	{"foo@", ""},
+	{"@foo.example", ""},
+	{"foo@127.0.0.1", ""},
+	{"foo@[::1]", ""},
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	for _, test := range normalizeTests {
+		got, err := NormalizeEmail(test.email)
+		if test.want == "" {
+			if !errors.Is(err, ErrInvalidEmail) {
+				t.Errorf("NormalizeEmail(%q): got %q, %v, want ErrInvalidEmail", test.email, got, err)
+			}
+		} else if err != nil {
+			t.Errorf("NormalizeEmail(%q): %s", test.email, err)
+		} else if got != test.want {
+			t.Errorf("NormalizeEmail(%q): got %q, want %q", test.email, got, test.want)
+		}
+	}
+}
+
+func TestNormalizeEmailIDN(t *testing.T) {
+	tests := []struct {
+		email string
+		want  string
+	}{
+		{"user@göteborg.test", "user@xn--gteborg-90a.test"},
+		{"user@xn--gteborg-90a.test", "user@xn--gteborg-90a.test"},
+		{"user@GÖTEBORG.Test", "user@xn--gteborg-90a.test"},
+		{"user@XN--GTEBORG-90A.TEST", "user@xn--gteborg-90a.test"},
+		{"user@göteborg.test.", "user@xn--gteborg-90a.test"},
+		{"Ünïcode@göteborg.test", "ünïcode@xn--gteborg-90a.test"},
+	}
+	for _, test := range tests {
+		got, err := NormalizeEmail(test.email)
+		if err != nil {
+			t.Errorf("NormalizeEmail(%q): %s", test.email, err)
+		} else if got != test.want {
+			t.Errorf("NormalizeEmail(%q): got %q, want %q", test.email, got, test.want)
+		}
+	}
+}
+
+func TestUnicodeEmail(t *testing.T) {
+	tests := []struct {
+		email string
+		want  string
+	}{
+		{"user@xn--gteborg-90a.test", "user@göteborg.test"},
+		{"user@XN--GTEBORG-90A.TEST", "user@göteborg.test"},
+		{"user@xn--gteborg-90a.test.", "user@göteborg.test"},
+		{"user@göteborg.test", "user@göteborg.test"},
+		{"User@example.com", "User@example.com"},
+	}
+	for _, test := range tests {
+		got, err := UnicodeEmail(test.email)
+		if err != nil {
+			t.Errorf("UnicodeEmail(%q): %s", test.email, err)
+		} else if got != test.want {
+			t.Errorf("UnicodeEmail(%q): got %q, want %q", test.email, got, test.want)
+		}
+	}
+}
+
+func TestPairingEmail(t *testing.T) {
+	want := pairingEmail("user@xn--gteborg-90a.test")
+	for _, email := range []string{"user@göteborg.test", "user@GÖTEBORG.test", "user@göteborg.test."} {
+		if got := pairingEmail(email); got != want {
+			t.Errorf("pairingEmail(%q): got %q, want %q", email, got, want)
+		}
+	}
+}
+
+func TestValidateEmail(t *testing.T) {
+	long := strings.Repeat("a", 63)
+	tests := []struct {
+		email string
+		valid bool
+	}{
+		{"user@example.com", true},
+		{"user.name+tag@sub.example.com", true},
+		{"user@localhost", true},
+		{"user@example.com.", true},
+		{"u@" + long + "." + long + "." + long + "." + strings.Repeat("a", 60), true},
+		{"üser@example.com", true},
+		{"user@göteborg.test", true},
+		{"user@xn--gteborg-90a.test", true},
+		{"user@bücher.例え.test", true},
+		{"first@last@example.com", true},
+
+		{"", false},
+		{"user", false},
+		{"user@", false},
+		{"@example.com", false},
+		{"user@.", false},
+		{"user@example..com", false},
+		{"user@.example.com", false},
+		{"user@-example.com", false},
+		{"user@example-.com", false},
+		{"user@exa_mple.com", false},
+		{"user@" + long + "a.com", false},
+		{"u@" + long + "." + long + "." + long + "." + strings.Repeat("a", 61), false},
+		{"user name@example.com", false},
+		{"user@example .com", false},
+		{"user\n@example.com", false},
+		{"user\x00@example.com", false},
+		{"user@127.0.0.1", false},
+		{"user@[127.0.0.1]", false},
+		{"user@::1", false},
+		{"user@[IPv6:::1]", false},
+		{"user@xn--zz.test", false},
+		{"user@\u0301a.test", false},
+	}
+	for _, test := range tests {
+		err := validateEmail(test.email)
+		if test.valid && err != nil {
+			t.Errorf("validateEmail(%q): %s", test.email, err)
+		} else if !test.valid && !errors.Is(err, ErrInvalidEmail) {
+			t.Errorf("validateEmail(%q): got %v, want ErrInvalidEmail", test.email, err)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package portier
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+// Errors returned by Client methods can be matched against these values using
+// errors.Is, to determine the cause of a failure.
+var (
+	// ErrBrokerUnreachable indicates the broker discovery document or keys
+	// could not be fetched.
+	ErrBrokerUnreachable = errors.New("broker unreachable")
+
+	// ErrBrokerUnavailable indicates requests to the broker are not attempted,
+	// because the circuit breaker opened after repeated failures. See
+	// Config.BreakerThreshold.
+	ErrBrokerUnavailable = errors.New("broker unavailable")
+
+	// ErrInvalidToken indicates the id_token is malformed or does not contain
+	// the expected claims.
+	ErrInvalidToken = errors.New("invalid token")
+
+	// ErrInvalidSignature indicates the id_token signature could not be
+	// verified using the keys of the broker.
+	ErrInvalidSignature = errors.New("invalid signature")
+
+	// ErrUnknownKey indicates the id_token was signed with a key that is not
+	// in the key set of the broker.
+	ErrUnknownKey = errors.New("unknown signing key")
+
+	// ErrTokenExpired indicates the id_token has expired. Usually, the user
+	// took too long to complete the login, and should try again.
+	ErrTokenExpired = errors.New("token expired")
+
+	// ErrTokenNotYetValid indicates the id_token is not valid yet, according to
+	// its iat or nbf claims. This usually points to clock skew between the
+	// application and the broker.
+	ErrTokenNotYetValid = errors.New("token not yet valid")
+
+	// ErrInvalidAudience indicates the id_token was issued for a different
+	// client. This usually points to a misconfigured RedirectURI.
+	ErrInvalidAudience = errors.New("invalid audience")
+
+	// ErrInvalidIssuer indicates the id_token was issued by a different broker.
+	// This usually points to a misconfigured Broker.
+	ErrInvalidIssuer = errors.New("invalid issuer")
+
+	// ErrInvalidSession indicates the login session was not found, because it
+	// expired, was already completed, or was started elsewhere.
+	ErrInvalidSession = errors.New("invalid session")
+
+	// ErrInvalidEmail indicates the email address given to StartAuth is not
+	// syntactically valid.
+	ErrInvalidEmail = errors.New("invalid email address")
+
+	// ErrEmailNotAllowed indicates the email address was rejected by the email
+	// policies in Config, such as Config.AllowedDomains.
+	ErrEmailNotAllowed = errors.New("email not allowed")
+
+	// ErrRateLimited indicates StartAuth was refused by Config.RateLimiter.
+	ErrRateLimited = errors.New("rate limited")
+
+	// ErrSessionStoreRequired indicates StartAuth was given WithData, or
+	// VerifyCallback was given a state, but the Store does not implement
+	// SessionStore.
+	ErrSessionStoreRequired = errors.New("session store required")
+)
+
+// BrokerError is returned by Client.VerifyCallback when the broker redirected
+// back to the application with an error instead of an id_token. For example,
+// the user may have cancelled the login.
+type BrokerError struct {
+	Code        string // The error parameter
+	Description string // The error_description parameter, which may be empty
+	State       string // The state parameter, which may be empty
+}
+
+func (err *BrokerError) Error() string {
+	if err.Description == "" {
+		return fmt.Sprintf("broker error: %s", err.Code)
+	}
+	return fmt.Sprintf("broker error: %s: %s", err.Code, err.Description)
+}
+
+// clientError is an error returned by Client methods, which matches one of
+// the exported error values above using errors.Is, and unwraps to the
+// underlying cause, if any.
+type clientError struct {
+	kind error
+	msg  string
+	err  error
+}
+
+func (err *clientError) Error() string {
+	return err.msg
+}
+
+func (err *clientError) Unwrap() error {
+	return err.err
+}
+
+func (err *clientError) Is(target error) bool {
+	return target == err.kind
+}
+
+// newError formats an error like fmt.Errorf, including wrapping using %w, and
+// associates it with one of the exported error values.
+func newError(kind error, format string, args ...interface{}) error {
+	err := fmt.Errorf(format, args...)
+	return &clientError{kind, err.Error(), errors.Unwrap(err)}
+}
+
+// parseError classifies an error returned by jwt.Parse.
+func parseError(err error) error {
+	kind := ErrInvalidToken
+	switch {
+	case errors.Is(err, jwt.ErrTokenExpired()):
+		kind = ErrTokenExpired
+	case errors.Is(err, jwt.ErrTokenNotYetValid()),
+		errors.Is(err, jwt.ErrInvalidIssuedAt()):
+		kind = ErrTokenNotYetValid
+	case errors.Is(err, jwt.ErrInvalidAudience()):
+		kind = ErrInvalidAudience
+	case errors.Is(err, jwt.ErrInvalidIssuer()):
+		kind = ErrInvalidIssuer
+	case jws.IsVerificationError(err):
+		kind = ErrInvalidSignature
+	}
+	return newError(kind, "jwt.Parse error: %w", err)
+}
+
+// checkHeaders returns an error if the token refers to a key ID that is not in
+// the key set, or uses an algorithm not in algs. jwt.Parse does not allow
+// distinguishing these cases. An empty algs allows any algorithm.
+//
+// As defense in depth, it also rejects unsigned tokens, tokens with critical
+// extension headers (none of which we understand), and tokens with a type
+// other than JWT, regardless of what jwt.Parse would accept.
+func checkHeaders(tokenStr string, keySet jwk.Set, algs []jwa.SignatureAlgorithm) error {
+	msg, err := jws.ParseString(tokenStr)
+	if err != nil {
+		return newError(ErrInvalidToken, "jws.Parse error: %w", err)
+	}
+
+	for _, sig := range msg.Signatures() {
+		headers := sig.ProtectedHeaders()
+		if headers.Algorithm() == jwa.NoSignature {
+			return newError(ErrInvalidSignature, "token is not signed")
+		}
+		if crit := headers.Critical(); len(crit) != 0 {
+			return newError(ErrInvalidToken, "token has unsupported critical headers: %s", strings.Join(crit, ", "))
+		}
+		if typ := headers.Type(); typ != "" && !strings.EqualFold(typ, "JWT") && !strings.EqualFold(typ, "application/jwt") {
+			return newError(ErrInvalidToken, "token has unexpected type: %s", typ)
+		}
+		if len(algs) != 0 && !containsAlgorithm(algs, headers.Algorithm()) {
+			return newError(ErrInvalidSignature, "token signed with disallowed algorithm: %s", headers.Algorithm())
+		}
+
+		kid := headers.KeyID()
+		if kid == "" {
+			continue
+		}
+		if _, ok := keySet.LookupKeyID(kid); !ok {
+			return newError(ErrUnknownKey, "token signed with unknown key ID: %s", kid)
+		}
+	}
+
+	return nil
+}
+
+func containsAlgorithm(algs []jwa.SignatureAlgorithm, alg jwa.SignatureAlgorithm) bool {
+	for _, allowed := range algs {
+		if allowed == alg {
+			return true
+		}
+	}
+	return false
+}
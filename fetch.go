@@ -1,54 +1,460 @@
 package portier
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
-	"regexp"
-	"strconv"
+	"runtime/debug"
 	"time"
+
+	"github.com/lestrrat-go/option"
 )
 
 const defaultMaxAge = time.Minute
-const defaultErrMaxAge = time.Duration(3) * time.Second
+const fetchLockTTL = DefaultHTTPTimeout
+const fetchLockPoll = time.Duration(100) * time.Millisecond
+
+// DefaultMaxResponseSize is the default limit on the size of response bodies
+// read by SimpleFetch.
+const DefaultMaxResponseSize = 1024 * 1024
+
+// DefaultUserAgent is the User-Agent header sent by SimpleFetch, so broker
+// operators can identify clients. It includes the version of this module, if
+// known from the build info.
+var DefaultUserAgent = defaultUserAgent()
+
+func defaultUserAgent() string {
+	const userAgent = "portier-go"
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return userAgent
+	}
+	if info.Main.Path == modulePath {
+		if version := info.Main.Version; version != "" && version != "(devel)" {
+			return userAgent + "/" + version
+		}
+		return userAgent
+	}
+	for _, dep := range info.Deps {
+		if dep.Path != modulePath {
+			continue
+		}
+		if dep.Replace != nil {
+			dep = dep.Replace // A local replacement has no version
+		}
+		if dep.Version != "" {
+			return userAgent + "/" + dep.Version
+		}
+		return userAgent
+	}
+	return userAgent
+}
+
+const modulePath = "github.com/portier/portier-go"
+
+// DefaultErrorCacheAge is the default cache lifespan of failed fetches. See
+// WithErrorCacheAge.
+const DefaultErrorCacheAge = time.Duration(3) * time.Second
+
+// DefaultRetryBackoff is the default delay before the first retry, when
+// SimpleFetch is used with WithRetries. It doubles with each retry.
+const DefaultRetryBackoff = time.Duration(100) * time.Millisecond
+
+// DefaultRetryStatusCodes are the HTTP status codes retried by default, when
+// SimpleFetch is used with WithRetries.
+var DefaultRetryStatusCodes = []int{
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// FetchOption is the interface for options accepted by SimpleFetch.
+type FetchOption = option.Interface
+type identMaxResponseSize struct{}
+type identCacheValidators struct{}
+type identHeaders struct{}
+type identUserAgent struct{}
+type identRetries struct{}
+type identMinCacheAge struct{}
+type identErrorCacheAge struct{}
+type identMaxCacheAge struct{}
+type identRetryBackoff struct{}
+type identRetryStatusCodes struct{}
+type identFetchClock struct{}
+
+// WithMaxResponseSize is used with SimpleFetch to limit the size in bytes of
+// the response body. Larger responses result in a *ResponseTooLarge error. The
+// default is DefaultMaxResponseSize.
+func WithMaxResponseSize(size int64) FetchOption {
+	return option.New(identMaxResponseSize{}, size)
+}
+
+// WithMinCacheAge is used with SimpleFetch to set the minimum cache lifespan
+// of successful responses, regardless of the Cache-Control header. Raising it
+// reduces load on the broker, lowering it makes brokers that send no-cache or
+// a short max-age contacted more often. The default is DefaultMinCacheAge.
+//
+// It can also be used with NewClientWithOptions to set Config.MinCacheAge.
+func WithMinCacheAge(age time.Duration) FetchOption {
+	return option.New(identMinCacheAge{}, age)
+}
+
+// WithMaxCacheAge is used with SimpleFetch to set the maximum cache lifespan
+// of successful responses, regardless of the Cache-Control header. Lowering it
+// bounds how long old keys are used after the broker rotates them. The
+// default is DefaultMaxCacheAge.
+//
+// It can also be used with NewClientWithOptions to set Config.MaxCacheAge.
+func WithMaxCacheAge(age time.Duration) FetchOption {
+	return option.New(identMaxCacheAge{}, age)
+}
+
+// WithErrorCacheAge is used with SimpleFetch to set the cache lifespan of
+// failed fetches, so the broker isn't contacted on every login while it is
+// down. Zero disables caching of errors. A longer Retry-After time of a 429 or
+// 503 response takes precedence. The default is DefaultErrorCacheAge.
+func WithErrorCacheAge(age time.Duration) FetchOption {
+	return option.New(identErrorCacheAge{}, age)
+}
 
-var maxAgeRe = regexp.MustCompile(`max-age\s*=\s*(\d+)`)
+// WithRetries is used with SimpleFetch to retry failed requests up to the
+// given number of times, for network errors and the status codes set by
+// WithRetryStatusCodes. Responses with a Retry-After header are not retried.
+// The default is zero, meaning no retries.
+func WithRetries(count int) FetchOption {
+	return option.New(identRetries{}, count)
+}
+
+// WithRetryBackoff is used with SimpleFetch to set the delay before the first
+// retry. It doubles with each retry. The default is DefaultRetryBackoff.
+func WithRetryBackoff(backoff time.Duration) FetchOption {
+	return option.New(identRetryBackoff{}, backoff)
+}
+
+// WithRetryStatusCodes is used with SimpleFetch to set the HTTP status codes
+// that are retried. The default is DefaultRetryStatusCodes.
+func WithRetryStatusCodes(codes ...int) FetchOption {
+	return option.New(identRetryStatusCodes{}, codes)
+}
+
+// WithFetchClock is used with SimpleFetch to set the clock used to interpret
+// an HTTP-date in the Retry-After header, so it agrees with the clock of the
+// cache storing the result. The default is time.Now. The MemoryStore passes
+// the clock set using WithClock.
+func WithFetchClock(clock func() time.Time) FetchOption {
+	return option.New(identFetchClock{}, clock)
+}
+
+// WithHeaders is used with SimpleFetch to add headers to the request, for
+// example an Authorization header for a broker behind an access-controlled
+// gateway. Note that the headers are also sent to the jwks_uri of the broker,
+// which may be on a different host. It can be given multiple times.
+func WithHeaders(header http.Header) FetchOption {
+	return option.New(identHeaders{}, header)
+}
+
+// WithUserAgent is used with SimpleFetch to override DefaultUserAgent. An empty
+// string omits the User-Agent header. A User-Agent set using WithHeaders takes
+// precedence, which is how it can be set for a Client using
+// Config.BrokerHeaders.
+func WithUserAgent(userAgent string) FetchOption {
+	return option.New(identUserAgent{}, userAgent)
+}
+
+// WithCacheValidators is used with SimpleFetch to make a conditional request
+// using the validators in v, if any. After a successful fetch, v is updated
+// with the validators of the response. If the server responds that the
+// document was not modified, SimpleFetch returns ErrNotModified.
+func WithCacheValidators(v *CacheValidators) FetchOption {
+	return option.New(identCacheValidators{}, v)
+}
+
+// CacheValidators are the HTTP validators of a cached document, used to
+// revalidate it with a conditional request instead of fetching it again.
+type CacheValidators struct {
+	ETag         string // The ETag header, sent as If-None-Match
+	LastModified string // The Last-Modified header, sent as If-Modified-Since
+
+	// MustRevalidate is set if the Cache-Control header forbids serving the
+	// document after it expires, as WithStaleIfError and
+	// WithStaleWhileRevalidate otherwise allow.
+	MustRevalidate bool
+}
+
+// ErrNotModified is returned by SimpleFetch for a conditional request, if the
+// document was not modified. The data is not decoded, and the cached copy
+// should be kept for the returned Duration.
+var ErrNotModified = errors.New("not modified")
+
+// ResponseTooLarge is returned by SimpleFetch when the response body exceeds
+// the size limit.
+type ResponseTooLarge struct {
+	URL   string // The URL that was fetched
+	Limit int64  // The size limit that was exceeded
+}
+
+func (err *ResponseTooLarge) Error() string {
+	return fmt.Sprintf("response from %s exceeds %d bytes", err.URL, err.Limit)
+}
 
 // SimpleFetch is a simple http.Client.Get wrapper that also decodes the JSON
 // response and parses the Cache-Control header. The returned Duration is the
-// cache lifespan for storing the result.
+// cache lifespan for storing the result. For successful responses, it is
+// based on the s-maxage, max-age, no-cache and no-store directives minus the
+// Age header, and bounded by WithMinCacheAge and WithMaxCacheAge. For errors,
+// it is set by WithErrorCacheAge, or the Retry-After time of a 429 or 503
+// response, up to 5 minutes.
 //
 // This is the default implementation for cache misses in Store.Fetch.
-func SimpleFetch(client *http.Client, url string, data interface{}) (time.Duration, error) {
-	maxAge := defaultErrMaxAge
+func SimpleFetch(client *http.Client, url string, data interface{}, options ...FetchOption) (time.Duration, error) {
+	return SimpleFetchContext(context.Background(), client, url, data, options...)
+}
+
+// SimpleFetchContext is like SimpleFetch, but the request, including any
+// retries, is cancelled when the context is done.
+func SimpleFetchContext(ctx context.Context, client *http.Client, url string, data interface{}, options ...FetchOption) (time.Duration, error) {
+	maxAge := DefaultErrorCacheAge
+	maxSize := int64(DefaultMaxResponseSize)
+	minCacheAge, maxCacheAge := DefaultMinCacheAge, DefaultMaxCacheAge
+	var validators *CacheValidators
+	var headers []http.Header
+	userAgent := DefaultUserAgent
+	retry := retryPolicy{backoff: DefaultRetryBackoff, statusCodes: DefaultRetryStatusCodes}
+	now := time.Now
+	for _, option := range options {
+		switch option.Ident() {
+		case identMaxResponseSize{}:
+			maxSize = option.Value().(int64)
+		case identCacheValidators{}:
+			validators = option.Value().(*CacheValidators)
+		case identHeaders{}:
+			headers = append(headers, option.Value().(http.Header))
+		case identUserAgent{}:
+			userAgent = option.Value().(string)
+		case identErrorCacheAge{}:
+			maxAge = option.Value().(time.Duration)
+		case identMinCacheAge{}:
+			minCacheAge = option.Value().(time.Duration)
+		case identMaxCacheAge{}:
+			maxCacheAge = option.Value().(time.Duration)
+		case identRetries{}:
+			retry.count = option.Value().(int)
+		case identRetryBackoff{}:
+			retry.backoff = option.Value().(time.Duration)
+		case identRetryStatusCodes{}:
+			retry.statusCodes = option.Value().([]int)
+		case identFetchClock{}:
+			now = option.Value().(func() time.Time)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return maxAge, err
+	}
+	for _, header := range headers {
+		for name, values := range header {
+			for _, value := range values {
+				req.Header.Add(name, value)
+			}
+		}
+	}
+	if _, ok := req.Header["User-Agent"]; !ok {
+		req.Header.Set("User-Agent", userAgent)
+	}
+	if validators != nil {
+		if validators.ETag != "" {
+			req.Header.Set("If-None-Match", validators.ETag)
+		}
+		if validators.LastModified != "" {
+			req.Header.Set("If-Modified-Since", validators.LastModified)
+		}
+	}
 
-	res, err := client.Get(url)
+	res, err := retry.do(client, req)
 	if err != nil {
 		return maxAge, err
 	}
 	defer res.Body.Close()
 
+	if res.StatusCode == http.StatusNotModified && validators != nil {
+		if etag := res.Header.Get("ETag"); etag != "" {
+			validators.ETag = etag
+		}
+		if lastModified := res.Header.Get("Last-Modified"); lastModified != "" {
+			validators.LastModified = lastModified
+		}
+		cc := parseCacheControl(res.Header)
+		validators.MustRevalidate = cc.mustRevalidate
+		return cc.lifespan(minCacheAge, maxCacheAge), ErrNotModified
+	}
 	if res.StatusCode != 200 {
+		if res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusServiceUnavailable {
+			if retryAfter := parseRetryAfter(res.Header, now()); retryAfter > maxAge {
+				maxAge = retryAfter
+			}
+		}
 		return maxAge, fmt.Errorf("unexpected HTTP status: %s", res.Status)
 	}
 
-	err = json.NewDecoder(res.Body).Decode(data)
+	body := &io.LimitedReader{R: res.Body, N: maxSize + 1}
+	err = json.NewDecoder(body).Decode(data)
+	if body.N <= 0 {
+		return maxAge, &ResponseTooLarge{URL: url, Limit: maxSize}
+	}
 	if err != nil {
 		return maxAge, err
 	}
 
-	maxAge = defaultMaxAge
+	cc := parseCacheControl(res.Header)
+	if validators != nil {
+		validators.ETag = res.Header.Get("ETag")
+		validators.LastModified = res.Header.Get("Last-Modified")
+		validators.MustRevalidate = cc.mustRevalidate
+	}
 
-	match := maxAgeRe.FindStringSubmatch(res.Header.Get("Cache-Control"))
-	if match != nil {
-		maxAgeInt, err := strconv.ParseInt(match[1], 10, 64)
-		if err == nil {
-			maxAgeParsed := time.Duration(maxAgeInt) * time.Second
-			if maxAgeParsed > maxAge {
-				maxAge = maxAgeParsed
-			}
+	return cc.lifespan(minCacheAge, maxCacheAge), nil
+}
+
+// retryPolicy holds the options set by WithRetries and related options.
+type retryPolicy struct {
+	count       int
+	backoff     time.Duration
+	statusCodes []int
+}
+
+// do performs the request, retrying according to the policy. The request must
+// not have a body, so it can be sent again.
+func (retry retryPolicy) do(client *http.Client, req *http.Request) (*http.Response, error) {
+	backoff := retry.backoff
+	for attempt := 0; ; attempt++ {
+		res, err := client.Do(req)
+		if attempt >= retry.count || !retry.retryable(res, err) {
+			return res, err
+		}
+		if res != nil {
+			io.Copy(io.Discard, io.LimitReader(res.Body, 4096)) // allow connection reuse
+			res.Body.Close()
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+		backoff *= 2
+	}
+}
+
+func (retry retryPolicy) retryable(res *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	if res.Header.Get("Retry-After") != "" {
+		return false
+	}
+	for _, code := range retry.statusCodes {
+		if res.StatusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// FetchAs is a typed wrapper around Store.Fetch. It allocates a zero value of
+// T and fetches url into it, so callers don't have to construct the double
+// pointer Store.Fetch expects.
+//
+// The returned value may be a copy shared with other callers, and must not be
+// modified.
+func FetchAs[T any](store Store, url string) (*T, error) {
+	data := new(T)
+	if err := store.Fetch(url, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// FetchAsContext is like FetchAs, but passes the context to the Store if it
+// implements FetchContextStore. Other Stores are called using Store.Fetch,
+// and can't be cancelled.
+func FetchAsContext[T any](ctx context.Context, store Store, url string) (*T, error) {
+	data := new(T)
+	var err error
+	if ctxStore, ok := store.(FetchContextStore); ok {
+		err = ctxStore.FetchContext(ctx, url, &data)
+	} else {
+		err = store.Fetch(url, &data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// CoordinatedFetch is a SimpleFetch variant for Store implementations with a
+// cache shared between processes. It uses a FetchLocker so that only one
+// process fetches the document when the shared cache goes cold.
+//
+// The lookup function should check the shared cache and, on a hit, fill data
+// and return true. It is called after acquiring the lock, in case another
+// process refreshed the cache in the meantime, and periodically while waiting
+// for the lock.
+//
+// The store function should write the result of the fetch to the shared
+// cache, including errors if they are cached. It is called before the lock is
+// released, so that waiting processes find the result on their next lookup
+// instead of fetching the document again. Failures to write the cache should
+// be handled by store itself, because the fetch result is valid regardless.
+//
+// If data was filled by lookup, the returned Duration is zero, and store is
+// not called. Otherwise, the return values are the same as for SimpleFetch.
+// If the lock could not be acquired within the lock timeout, this function
+// falls back to fetching without the lock.
+//
+// Options are passed on to SimpleFetch.
+func CoordinatedFetch(locker FetchLocker, client *http.Client, url string, data interface{}, lookup func() (bool, error), store func(maxAge time.Duration, err error), options ...FetchOption) (time.Duration, error) {
+	return CoordinatedFetchContext(context.Background(), locker, client, url, data, lookup, store, options...)
+}
+
+// CoordinatedFetchContext is like CoordinatedFetch, but waiting for the lock
+// and the request are cancelled when the context is done.
+func CoordinatedFetchContext(ctx context.Context, locker FetchLocker, client *http.Client, url string, data interface{}, lookup func() (bool, error), store func(maxAge time.Duration, err error), options ...FetchOption) (time.Duration, error) {
+	deadline := time.Now().Add(fetchLockTTL)
+	for time.Now().Before(deadline) {
+		locked, err := locker.TryLockFetch(url, fetchLockTTL)
+		if err != nil {
+			return DefaultErrorCacheAge, err
+		}
+
+		if locked {
+			defer locker.UnlockFetch(url)
+		}
+
+		hit, err := lookup()
+		if err != nil {
+			return DefaultErrorCacheAge, err
+		}
+		if hit {
+			return 0, nil
+		}
+
+		if locked {
+			break
+		}
+		select {
+		case <-time.After(fetchLockPoll):
+		case <-ctx.Done():
+			return DefaultErrorCacheAge, ctx.Err()
 		}
 	}
 
+	maxAge, err := SimpleFetchContext(ctx, client, url, data, options...)
+	store(maxAge, err)
 	return maxAge, err
 }
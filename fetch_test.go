@@ -0,0 +1,181 @@
+package portier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// sharedCache is a FetchLocker with a cache, standing in for a cache shared
+// between processes, like Redis.
+type sharedCache struct {
+	sync.Mutex
+	locks map[string]bool
+	docs  map[string]map[string]string
+}
+
+func (cache *sharedCache) TryLockFetch(url string, ttl time.Duration) (bool, error) {
+	cache.Lock()
+	defer cache.Unlock()
+	if cache.locks[url] {
+		return false, nil
+	}
+	cache.locks[url] = true
+	return true, nil
+}
+
+func (cache *sharedCache) UnlockFetch(url string) error {
+	cache.Lock()
+	defer cache.Unlock()
+	delete(cache.locks, url)
+	return nil
+}
+
+func TestCoordinatedFetchSingleRequest(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprint(w, `{"jwks_uri":"https://broker.test/jwks.json"}`)
+	}))
+	defer server.Close()
+
+	cache := &sharedCache{
+		locks: make(map[string]bool),
+		docs:  make(map[string]map[string]string),
+	}
+	url := server.URL + discoveryPath
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var data map[string]string
+			lookup := func() (bool, error) {
+				cache.Lock()
+				defer cache.Unlock()
+				doc, ok := cache.docs[url]
+				if ok {
+					data = doc
+				}
+				return ok, nil
+			}
+			store := func(maxAge time.Duration, err error) {
+				if err != nil {
+					return
+				}
+				cache.Lock()
+				defer cache.Unlock()
+				cache.docs[url] = data
+			}
+			if _, err := CoordinatedFetch(cache, server.Client(), url, &data, lookup, store); err != nil {
+				t.Error(err)
+				return
+			}
+			if data["jwks_uri"] != "https://broker.test/jwks.json" {
+				t.Errorf("unexpected document: %v", data)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if hits := atomic.LoadInt32(&hits); hits != 1 {
+		t.Errorf("broker was hit %d times, want 1", hits)
+	}
+}
+
+func TestSimpleFetchRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		retries  int
+		statuses []int // responses in order, the last one repeats
+		header   http.Header
+		want     int32 // number of requests
+		ok       bool
+	}{
+		{"no retries", 0, []int{503}, nil, 1, false},
+		{"retryable status", 2, []int{503}, nil, 3, false},
+		{"recovers", 3, []int{500, 502, 200}, nil, 3, true},
+		{"not retryable", 3, []int{404}, nil, 1, false},
+		{"retry after", 3, []int{503}, http.Header{"Retry-After": {"1"}}, 1, false},
+		{"network error", 2, []int{0}, nil, 3, false},
+	}
+	for _, test := range tests {
+		var requests atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := int(requests.Add(1))
+			if n > len(test.statuses) {
+				n = len(test.statuses)
+			}
+			status := test.statuses[n-1]
+			if status == 0 {
+				// Drop the connection without a response.
+				conn, _, err := w.(http.Hijacker).Hijack()
+				if err == nil {
+					conn.Close()
+				}
+				return
+			}
+			for name, values := range test.header {
+				w.Header()[name] = values
+			}
+			w.WriteHeader(status)
+			fmt.Fprint(w, `{}`)
+		}))
+
+		var data map[string]string
+		_, err := SimpleFetch(srv.Client(), srv.URL, &data, WithRetries(test.retries), WithRetryBackoff(time.Millisecond))
+		if test.ok && err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("%s: fetch succeeded", test.name)
+		}
+		if got := requests.Load(); got != test.want {
+			t.Errorf("%s: got %d requests, want %d", test.name, got, test.want)
+		}
+		srv.Close()
+	}
+}
+
+func TestSimpleFetchRetryBackoff(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	// Backoffs of 20ms, 40ms and 80ms.
+	start := time.Now()
+	var data map[string]string
+	SimpleFetch(srv.Client(), srv.URL, &data, WithRetries(3), WithRetryBackoff(20*time.Millisecond))
+	if elapsed := time.Since(start); elapsed < 140*time.Millisecond {
+		t.Errorf("retries took %s, want at least 140ms", elapsed)
+	}
+	if got := requests.Load(); got != 4 {
+		t.Errorf("got %d requests, want 4", got)
+	}
+
+	// Cancelling the context stops waiting for the next retry.
+	requests.Store(0)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, err := SimpleFetchContext(ctx, srv.Client(), srv.URL, &data, WithRetries(3), WithRetryBackoff(time.Hour))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("cancelled fetch took %s", elapsed)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("got %d requests, want 1", got)
+	}
+}
@@ -0,0 +1,62 @@
+package portier
+
+import (
+	"net/http"
+)
+
+// fragmentPage is served by FragmentHandler. It copies the parameters from the
+// URL fragment into a form, and submits it to the same URL.
+const fragmentPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Logging in…</title>
+</head>
+<body>
+<noscript>JavaScript is required to complete the login.</noscript>
+<form id="portier-callback" method="post"></form>
+<script>
+(function () {
+  var form = document.getElementById("portier-callback");
+  var params = new URLSearchParams(location.hash.slice(1));
+  params.forEach(function (value, name) {
+    var input = document.createElement("input");
+    input.type = "hidden";
+    input.name = name;
+    input.value = value;
+    form.appendChild(input);
+  });
+  history.replaceState(null, "", location.pathname + location.search);
+  form.submit();
+})();
+</script>
+</body>
+</html>
+`
+
+// FragmentHandler wraps the handler for the RedirectURI of a Client using
+// ResponseModeFragment.
+//
+// In fragment mode, the broker redirects the user agent to the RedirectURI
+// with the id_token in the URL fragment, which is not sent to the server. This
+// handler responds to such GET requests with a small page containing
+// JavaScript that re-submits the fragment parameters as a form POST to the
+// same URL. All other requests are passed to next, which can then use
+// Client.VerifyRequest as it would in form_post mode.
+func FragmentHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header := w.Header()
+		header.Set("Content-Type", "text/html; charset=utf-8")
+		header.Set("Cache-Control", "no-store")
+		header.Set("Referrer-Policy", "no-referrer")
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write([]byte(fragmentPage))
+		}
+	})
+}
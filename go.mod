@@ -1,10 +1,22 @@
 module github.com/portier/portier-go
 
-go 1.16
+go 1.20
 
 require (
-	github.com/goccy/go-json v0.10.4 // indirect
 	github.com/lestrrat-go/jwx/v2 v2.1.3
 	github.com/lestrrat-go/option v1.0.1
+	golang.org/x/net v0.33.0
+	golang.org/x/text v0.21.0
+)
+
+require (
+	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.3.0 // indirect
+	github.com/goccy/go-json v0.10.4 // indirect
+	github.com/lestrrat-go/blackmagic v1.0.2 // indirect
+	github.com/lestrrat-go/httpcc v1.0.1 // indirect
+	github.com/lestrrat-go/httprc v1.0.6 // indirect
+	github.com/lestrrat-go/iter v1.0.2 // indirect
+	github.com/segmentio/asm v1.2.0 // indirect
 	golang.org/x/crypto v0.31.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
 )
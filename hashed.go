@@ -0,0 +1,127 @@
+package portier
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// NewHashedNonceStore wraps a Store so that nonces and email addresses are
+// only kept in hashed form in the inner Store. A leaked copy of the inner
+// store then does not reveal the nonces of in-flight logins, nor the email
+// addresses of the users logging in.
+//
+// The wrapper generates a secret of its own for each nonce, and passes only a
+// hash of the secret and email address to the inner Store in place of the
+// email address. The nonce sent to the broker combines the nonce of the inner
+// Store with the secret. It works with any Store, but nonces created without
+// the wrapper can't be consumed with it, and vice versa.
+//
+// The secrets are generated like nonces of a MemoryStore, and the WithRandom
+// and WithNonceGenerator options can be given to configure this. Other options
+// are ignored. A NonceGenerator used here must not produce dots.
+//
+// If the inner Store implements SessionStore, so does the returned Store.
+// Session data is stored as-is. Other optional interfaces are not passed on.
+func NewHashedNonceStore(inner Store, options ...MemoryStoreOption) Store {
+	store := &hashedStore{
+		Store:    inner,
+		random:   rand.Reader,
+		generate: GenerateNonceFrom,
+	}
+	for _, option := range options {
+		switch option.Ident() {
+		case identRandom{}:
+			store.random = option.Value().(io.Reader)
+		case identNonceGenerator{}:
+			store.generate = option.Value().(NonceGenerator)
+		}
+	}
+
+	if sessionStore, ok := inner.(SessionStore); ok {
+		return &hashedSessionStore{store, sessionStore}
+	}
+	return store
+}
+
+type hashedStore struct {
+	Store
+	random   io.Reader
+	generate NonceGenerator
+}
+
+type hashedSessionStore struct {
+	*hashedStore
+	sessionStore SessionStore
+}
+
+// hashEmail returns the value passed to the inner Store in place of the email.
+func hashEmail(secret string, email string) string {
+	sum := sha256.Sum256([]byte(secret + ":" + email))
+	return hex.EncodeToString(sum[:])
+}
+
+// newSecret generates the secret for a nonce.
+func (store *hashedStore) newSecret() (string, error) {
+	secret, err := store.generate(store.random)
+	if err != nil {
+		return "", fmt.Errorf("could not generate nonce secret: %w", err)
+	}
+	if secret == "" || strings.Contains(secret, ".") {
+		return "", fmt.Errorf("could not generate nonce secret: invalid format: %q", secret)
+	}
+	return secret, nil
+}
+
+// splitNonce splits a nonce created by the wrapper into the nonce of the inner
+// Store and the secret.
+func splitNonce(nonce string) (string, string, error) {
+	i := strings.LastIndexByte(nonce, '.')
+	if i < 0 {
+		return "", "", &InvalidNonce{}
+	}
+	return nonce[:i], nonce[i+1:], nil
+}
+
+func (store *hashedStore) NewNonce(email string) (string, error) {
+	secret, err := store.newSecret()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := store.Store.NewNonce(hashEmail(secret, email))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s.%s", nonce, secret), nil
+}
+
+func (store *hashedStore) ConsumeNonce(nonce string, email string) error {
+	inner, secret, err := splitNonce(nonce)
+	if err != nil {
+		return err
+	}
+	return store.Store.ConsumeNonce(inner, hashEmail(secret, email))
+}
+
+func (store *hashedSessionStore) NewSession(email string, session *Session) (string, error) {
+	secret, err := store.newSecret()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := store.sessionStore.NewSession(hashEmail(secret, email), session)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s.%s", nonce, secret), nil
+}
+
+func (store *hashedSessionStore) ConsumeSession(nonce string, email string) (*Session, error) {
+	inner, secret, err := splitNonce(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return store.sessionStore.ConsumeSession(inner, hashEmail(secret, email))
+}
@@ -0,0 +1,112 @@
+package portier
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHashedNonceStore(t *testing.T) {
+	inner := NewMemoryStore(&http.Client{})
+	store := NewHashedNonceStore(inner)
+
+	nonce, err := store.NewNonce("user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The inner store only has hashed values.
+	var saved bytes.Buffer
+	if err := inner.SaveNonces(&saved); err != nil {
+		t.Fatal(err)
+	}
+	_, secret, _ := splitNonce(nonce)
+	if strings.Contains(saved.String(), "user@example.com") || strings.Contains(saved.String(), secret) {
+		t.Errorf("inner store contains the email or secret: %s", saved.String())
+	}
+
+	tampered := []string{
+		nonce[:len(nonce)-1] + flipHex(nonce[len(nonce)-1]), // secret
+		flipHex(nonce[0]) + nonce[1:],                       // inner nonce
+		strings.Replace(nonce, ".", "", 1),                  // no separator
+		secret,
+	}
+	for _, bad := range tampered {
+		var invalid *InvalidNonce
+		if err := store.ConsumeNonce(bad, "user@example.com"); !errors.As(err, &invalid) {
+			t.Errorf("tampered nonce %q: got %v, want InvalidNonce", bad, err)
+		}
+	}
+	var invalid *InvalidNonce
+	if err := store.ConsumeNonce(nonce, "other@example.com"); !errors.As(err, &invalid) {
+		t.Errorf("other email: got %v, want InvalidNonce", err)
+	}
+
+	if err := store.ConsumeNonce(nonce, "user@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.ConsumeNonce(nonce, "user@example.com"); !errors.As(err, &invalid) {
+		t.Errorf("consumed nonce: got %v, want InvalidNonce", err)
+	}
+}
+
+func TestHashedNonceStoreSession(t *testing.T) {
+	store := NewHashedNonceStore(NewMemoryStore(&http.Client{})).(SessionStore)
+	nonce, err := store.NewSession("user@example.com", &Session{State: "state"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.ConsumeSession(nonce+"0", "user@example.com"); err == nil {
+		t.Error("tampered nonce was accepted")
+	}
+	session, err := store.ConsumeSession(nonce, "user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.State != "state" {
+		t.Errorf("unexpected state: %s", session.State)
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, io.ErrUnexpectedEOF
+}
+
+func TestHashedNonceStoreOptions(t *testing.T) {
+	inner := NewMemoryStore(&http.Client{})
+	store := NewHashedNonceStore(inner, WithRandom(failingReader{}))
+	if _, err := store.NewNonce("user@example.com"); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("failing RNG: got %v, want ErrUnexpectedEOF", err)
+	}
+
+	store = NewHashedNonceStore(inner, WithNonceGenerator(Base64NonceGenerator(32)))
+	nonce, err := store.NewNonce("user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, secret, _ := splitNonce(nonce); len(secret) != 43 {
+		t.Errorf("secret not generated by the configured generator: %s", secret)
+	}
+	if err := store.ConsumeNonce(nonce, "user@example.com"); err != nil {
+		t.Error(err)
+	}
+
+	dotted := func(io.Reader) (string, error) { return "a.b", nil }
+	store = NewHashedNonceStore(inner, WithNonceGenerator(dotted))
+	if _, err := store.NewNonce("user@example.com"); err == nil {
+		t.Error("secret with a dot was accepted")
+	}
+}
+
+// flipHex returns a different hex digit than c.
+func flipHex(c byte) string {
+	if c == '0' {
+		return "1"
+	}
+	return "0"
+}
@@ -0,0 +1,44 @@
+package portier
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+// keySetCache keeps the parsed and pinned key set for each broker, so that
+// verifying a token doesn't go through Store.Fetch for the discovery document
+// and key set every time.
+type keySetCache struct {
+	lock    sync.Mutex
+	entries map[string]keySetEntry // by broker
+}
+
+type keySetEntry struct {
+	keySet  jwk.Set
+	expires time.Time
+}
+
+// get returns the cached key set for the broker, or nil if there is none or
+// it expired.
+func (cache *keySetCache) get(broker string, now time.Time) jwk.Set {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	entry, ok := cache.entries[broker]
+	if !ok || !now.Before(entry.expires) {
+		return nil
+	}
+	return entry.keySet
+}
+
+func (cache *keySetCache) add(broker string, keySet jwk.Set, expires time.Time) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if cache.entries == nil {
+		cache.entries = make(map[string]keySetEntry)
+	}
+	cache.entries[broker] = keySetEntry{keySet, expires}
+}
@@ -0,0 +1,379 @@
+package portier
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/lestrrat-go/option"
+)
+
+// ClientOption is the interface for options accepted by NewClientWithOptions.
+type ClientOption = option.Interface
+type identStore struct{}
+type identBroker struct{}
+type identFallbackBrokers struct{}
+type identBreakerThreshold struct{}
+type identKeyCacheTTL struct{}
+type identBreakerCooldown struct{}
+type identRedirectURI struct{}
+type identResponseMode struct{}
+type identScopes struct{}
+type identLeeway struct{}
+type identExpLeeway struct{}
+type identNbfLeeway struct{}
+type identIatLeeway struct{}
+type identMaxTokenSize struct{}
+type identSessionTTL struct{}
+type identRetryWindow struct{}
+type identCheckTokenID struct{}
+type identParseOptions struct{}
+type identAllowedAlgorithms struct{}
+type identPinnedKeys struct{}
+type identTLSConfig struct{}
+type identHTTPClient struct{}
+type identProxy struct{}
+type identDialContext struct{}
+type identBrokerHeaders struct{}
+type identRequiredClaim struct{}
+type identForbiddenClaims struct{}
+type identValidator struct{}
+type identAllowedDomains struct{}
+type identDeniedDomains struct{}
+type identEmailPolicy struct{}
+type identRateLimiter struct{}
+type identRequireHTTPS struct{}
+type identAdditionalAudiences struct{}
+type identStrictAudience struct{}
+type identCheckEmailVerified struct{}
+type identRequireEmailVerified struct{}
+
+type requiredClaim struct {
+	name  string
+	value interface{}
+}
+
+// WithStore is used with NewClientWithOptions to set Config.Store.
+func WithStore(store Store) ClientOption {
+	return option.New(identStore{}, store)
+}
+
+// WithBroker is used with NewClientWithOptions to set Config.Broker.
+func WithBroker(broker string) ClientOption {
+	return option.New(identBroker{}, broker)
+}
+
+// WithFallbackBrokers is used with NewClientWithOptions to add to
+// Config.FallbackBrokers. It can be given multiple times.
+func WithFallbackBrokers(brokers ...string) ClientOption {
+	return option.New(identFallbackBrokers{}, brokers)
+}
+
+// WithKeyCacheTTL is used with NewClientWithOptions to set Config.KeyCacheTTL.
+func WithKeyCacheTTL(ttl time.Duration) ClientOption {
+	return option.New(identKeyCacheTTL{}, ttl)
+}
+
+// WithBreakerThreshold is used with NewClientWithOptions to set
+// Config.BreakerThreshold.
+func WithBreakerThreshold(failures int) ClientOption {
+	return option.New(identBreakerThreshold{}, failures)
+}
+
+// WithBreakerCooldown is used with NewClientWithOptions to set
+// Config.BreakerCooldown.
+func WithBreakerCooldown(cooldown time.Duration) ClientOption {
+	return option.New(identBreakerCooldown{}, cooldown)
+}
+
+// WithRedirectURI is used with NewClientWithOptions to set Config.RedirectURI.
+//
+// It can also be used with StartAuth, to return to a different route for a
+// single session. The URL must have the same origin as Config.RedirectURI,
+// because the origin is the client ID.
+func WithRedirectURI(redirectURI string) ClientOption {
+	return option.New(identRedirectURI{}, redirectURI)
+}
+
+// WithResponseMode is used with NewClientWithOptions to set
+// Config.ResponseMode.
+//
+// It can also be used with StartAuth, to override the response mode for a
+// single session. For example, a single-page app may use fragment, while
+// server-rendered pages use form_post.
+func WithResponseMode(responseMode string) ClientOption {
+	return option.New(identResponseMode{}, responseMode)
+}
+
+// WithScopes is used with NewClientWithOptions to set Config.Scopes.
+func WithScopes(scopes ...string) ClientOption {
+	return option.New(identScopes{}, scopes)
+}
+
+// WithLeeway is used with NewClientWithOptions to set Config.Leeway.
+func WithLeeway(leeway time.Duration) ClientOption {
+	return option.New(identLeeway{}, leeway)
+}
+
+// WithExpLeeway is used with NewClientWithOptions to set Config.ExpLeeway.
+func WithExpLeeway(leeway time.Duration) ClientOption {
+	return option.New(identExpLeeway{}, leeway)
+}
+
+// WithNbfLeeway is used with NewClientWithOptions to set Config.NbfLeeway.
+func WithNbfLeeway(leeway time.Duration) ClientOption {
+	return option.New(identNbfLeeway{}, leeway)
+}
+
+// WithIatLeeway is used with NewClientWithOptions to set Config.IatLeeway.
+func WithIatLeeway(leeway time.Duration) ClientOption {
+	return option.New(identIatLeeway{}, leeway)
+}
+
+// WithMaxTokenSize is used with NewClientWithOptions to set
+// Config.MaxTokenSize.
+func WithMaxTokenSize(size int) ClientOption {
+	return option.New(identMaxTokenSize{}, size)
+}
+
+// WithSessionTTL is used with NewClientWithOptions to set Config.SessionTTL.
+func WithSessionTTL(ttl time.Duration) ClientOption {
+	return option.New(identSessionTTL{}, ttl)
+}
+
+// WithRetryWindow is used with NewClientWithOptions to set
+// Config.RetryWindow.
+func WithRetryWindow(window time.Duration) ClientOption {
+	return option.New(identRetryWindow{}, window)
+}
+
+// WithCheckTokenID is used with NewClientWithOptions to set
+// Config.CheckTokenID.
+func WithCheckTokenID(check bool) ClientOption {
+	return option.New(identCheckTokenID{}, check)
+}
+
+// WithAllowedAlgorithms is used with NewClientWithOptions to set
+// Config.AllowedAlgorithms.
+func WithAllowedAlgorithms(algs ...jwa.SignatureAlgorithm) ClientOption {
+	return option.New(identAllowedAlgorithms{}, algs)
+}
+
+// WithPinnedKeys is used with NewClientWithOptions to set Config.PinnedKeys.
+func WithPinnedKeys(thumbprints ...string) ClientOption {
+	return option.New(identPinnedKeys{}, thumbprints)
+}
+
+// WithAdditionalAudiences is used with NewClientWithOptions to add to
+// Config.AdditionalAudiences. It can be given multiple times.
+func WithAdditionalAudiences(audiences ...string) ClientOption {
+	return option.New(identAdditionalAudiences{}, audiences)
+}
+
+// WithStrictAudience is used with NewClientWithOptions to set
+// Config.StrictAudience.
+func WithStrictAudience(strict bool) ClientOption {
+	return option.New(identStrictAudience{}, strict)
+}
+
+// WithCheckEmailVerified is used with NewClientWithOptions to set
+// Config.CheckEmailVerified.
+func WithCheckEmailVerified(check bool) ClientOption {
+	return option.New(identCheckEmailVerified{}, check)
+}
+
+// WithRequireEmailVerified is used with NewClientWithOptions to set
+// Config.RequireEmailVerified.
+func WithRequireEmailVerified(require bool) ClientOption {
+	return option.New(identRequireEmailVerified{}, require)
+}
+
+// WithRequiredClaim is used with NewClientWithOptions to add to
+// Config.RequiredClaims. It can be given multiple times.
+func WithRequiredClaim(name string, value interface{}) ClientOption {
+	return option.New(identRequiredClaim{}, requiredClaim{name, value})
+}
+
+// WithForbiddenClaims is used with NewClientWithOptions to add to
+// Config.ForbiddenClaims. It can be given multiple times.
+func WithForbiddenClaims(names ...string) ClientOption {
+	return option.New(identForbiddenClaims{}, names)
+}
+
+// WithValidator is used with NewClientWithOptions to add to
+// Config.Validators. It can be given multiple times.
+func WithValidator(validator func(token jwt.Token) error) ClientOption {
+	return option.New(identValidator{}, validator)
+}
+
+// WithAllowedDomains is used with NewClientWithOptions to add to
+// Config.AllowedDomains. It can be given multiple times.
+func WithAllowedDomains(domains ...string) ClientOption {
+	return option.New(identAllowedDomains{}, domains)
+}
+
+// WithDeniedDomains is used with NewClientWithOptions to add to
+// Config.DeniedDomains. It can be given multiple times.
+func WithDeniedDomains(domains ...string) ClientOption {
+	return option.New(identDeniedDomains{}, domains)
+}
+
+// WithEmailPolicy is used with NewClientWithOptions to set Config.EmailPolicy.
+func WithEmailPolicy(policy func(email string) error) ClientOption {
+	return option.New(identEmailPolicy{}, policy)
+}
+
+// WithRateLimiter is used with NewClientWithOptions to set Config.RateLimiter.
+func WithRateLimiter(limiter RateLimiter) ClientOption {
+	return option.New(identRateLimiter{}, limiter)
+}
+
+// WithRequireHTTPS is used with NewClientWithOptions to set
+// Config.RequireHTTPS.
+func WithRequireHTTPS(requireHTTPS bool) ClientOption {
+	return option.New(identRequireHTTPS{}, requireHTTPS)
+}
+
+// WithBrokerHeaders is used with NewClientWithOptions to add to
+// Config.BrokerHeaders. It can be given multiple times.
+func WithBrokerHeaders(header http.Header) ClientOption {
+	return option.New(identBrokerHeaders{}, header)
+}
+
+// WithHTTPClient is used with NewClientWithOptions to set Config.HTTPClient.
+func WithHTTPClient(httpClient *http.Client) ClientOption {
+	return option.New(identHTTPClient{}, httpClient)
+}
+
+// WithProxy is used with NewClientWithOptions to set Config.Proxy.
+func WithProxy(proxy func(*http.Request) (*url.URL, error)) ClientOption {
+	return option.New(identProxy{}, proxy)
+}
+
+// WithDialContext is used with NewClientWithOptions to set Config.DialContext.
+func WithDialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) ClientOption {
+	return option.New(identDialContext{}, dial)
+}
+
+// WithTLSConfig is used with NewClientWithOptions to set Config.TLSConfig.
+func WithTLSConfig(tlsConfig *tls.Config) ClientOption {
+	return option.New(identTLSConfig{}, tlsConfig)
+}
+
+// WithParseOptions is used with NewClientWithOptions to add to
+// Config.ParseOptions. It can be given multiple times.
+func WithParseOptions(options ...jwt.ParseOption) ClientOption {
+	return option.New(identParseOptions{}, options)
+}
+
+// NewClientWithOptions constructs a Client from options, as an alternative to
+// NewClient. Each Config field has a corresponding option. Fields that are
+// not set fall back to the same defaults as in NewClient.
+//
+// WithClock sets Config.Clock, and WithNonceGenerator sets
+// Config.NonceGenerator.
+func NewClientWithOptions(options ...ClientOption) (Client, error) {
+	cfg := &Config{}
+	for _, option := range options {
+		switch option.Ident() {
+		case identStore{}:
+			cfg.Store = option.Value().(Store)
+		case identBroker{}:
+			cfg.Broker = option.Value().(string)
+		case identFallbackBrokers{}:
+			cfg.FallbackBrokers = append(cfg.FallbackBrokers, option.Value().([]string)...)
+		case identKeyCacheTTL{}:
+			cfg.KeyCacheTTL = option.Value().(time.Duration)
+		case identBreakerThreshold{}:
+			cfg.BreakerThreshold = option.Value().(int)
+		case identBreakerCooldown{}:
+			cfg.BreakerCooldown = option.Value().(time.Duration)
+		case identRedirectURI{}:
+			cfg.RedirectURI = option.Value().(string)
+		case identResponseMode{}:
+			cfg.ResponseMode = option.Value().(string)
+		case identScopes{}:
+			cfg.Scopes = option.Value().([]string)
+		case identLeeway{}:
+			cfg.Leeway = option.Value().(time.Duration)
+		case identExpLeeway{}:
+			cfg.ExpLeeway = option.Value().(time.Duration)
+		case identNbfLeeway{}:
+			cfg.NbfLeeway = option.Value().(time.Duration)
+		case identIatLeeway{}:
+			cfg.IatLeeway = option.Value().(time.Duration)
+		case identMaxTokenSize{}:
+			cfg.MaxTokenSize = option.Value().(int)
+		case identSessionTTL{}:
+			cfg.SessionTTL = option.Value().(time.Duration)
+		case identRetryWindow{}:
+			cfg.RetryWindow = option.Value().(time.Duration)
+		case identCheckTokenID{}:
+			cfg.CheckTokenID = option.Value().(bool)
+		case identClock{}:
+			cfg.Clock = option.Value().(func() time.Time)
+		case identAllowedAlgorithms{}:
+			cfg.AllowedAlgorithms = option.Value().([]jwa.SignatureAlgorithm)
+		case identPinnedKeys{}:
+			cfg.PinnedKeys = option.Value().([]string)
+		case identAdditionalAudiences{}:
+			cfg.AdditionalAudiences = append(cfg.AdditionalAudiences, option.Value().([]string)...)
+		case identStrictAudience{}:
+			cfg.StrictAudience = option.Value().(bool)
+		case identCheckEmailVerified{}:
+			cfg.CheckEmailVerified = option.Value().(bool)
+		case identRequireEmailVerified{}:
+			cfg.RequireEmailVerified = option.Value().(bool)
+		case identRequiredClaim{}:
+			claim := option.Value().(requiredClaim)
+			if cfg.RequiredClaims == nil {
+				cfg.RequiredClaims = make(map[string]interface{})
+			}
+			cfg.RequiredClaims[claim.name] = claim.value
+		case identForbiddenClaims{}:
+			cfg.ForbiddenClaims = append(cfg.ForbiddenClaims, option.Value().([]string)...)
+		case identValidator{}:
+			cfg.Validators = append(cfg.Validators, option.Value().(func(token jwt.Token) error))
+		case identAllowedDomains{}:
+			cfg.AllowedDomains = append(cfg.AllowedDomains, option.Value().([]string)...)
+		case identDeniedDomains{}:
+			cfg.DeniedDomains = append(cfg.DeniedDomains, option.Value().([]string)...)
+		case identEmailPolicy{}:
+			cfg.EmailPolicy = option.Value().(func(email string) error)
+		case identRateLimiter{}:
+			cfg.RateLimiter = option.Value().(RateLimiter)
+		case identRequireHTTPS{}:
+			cfg.RequireHTTPS = option.Value().(bool)
+		case identTLSConfig{}:
+			cfg.TLSConfig = option.Value().(*tls.Config)
+		case identHTTPClient{}:
+			cfg.HTTPClient = option.Value().(*http.Client)
+		case identProxy{}:
+			cfg.Proxy = option.Value().(func(*http.Request) (*url.URL, error))
+		case identDialContext{}:
+			cfg.DialContext = option.Value().(func(ctx context.Context, network, addr string) (net.Conn, error))
+		case identBrokerHeaders{}:
+			if cfg.BrokerHeaders == nil {
+				cfg.BrokerHeaders = make(http.Header)
+			}
+			for name, values := range option.Value().(http.Header) {
+				cfg.BrokerHeaders[name] = append(cfg.BrokerHeaders[name], values...)
+			}
+		case identMinCacheAge{}:
+			cfg.MinCacheAge = option.Value().(time.Duration)
+		case identMaxCacheAge{}:
+			cfg.MaxCacheAge = option.Value().(time.Duration)
+		case identNonceGenerator{}:
+			cfg.NonceGenerator = option.Value().(NonceGenerator)
+		case identParseOptions{}:
+			cfg.ParseOptions = append(cfg.ParseOptions, option.Value().([]jwt.ParseOption)...)
+		}
+	}
+
+	return NewClient(cfg)
+}
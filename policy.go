@@ -0,0 +1,49 @@
+package portier
+
+import (
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// checkEmail applies the email policies from Config to an email address, both
+// in StartAuth and after verifying a token.
+func (client *client) checkEmail(email string) error {
+	_, domain := splitEmail(pairingEmail(email))
+	domain = normalizeDomain(domain)
+
+	if client.allowedDomains != nil && !client.allowedDomains[domain] {
+		return newError(ErrEmailNotAllowed, "email domain not allowed: %s", domain)
+	}
+	if client.deniedDomains[domain] {
+		return newError(ErrEmailNotAllowed, "email domain denied: %s", domain)
+	}
+	if client.emailPolicy != nil {
+		if err := client.emailPolicy(email); err != nil {
+			return newError(ErrEmailNotAllowed, "email not allowed: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// domainSet converts a list of domains to a set for lookup by checkEmail.
+func domainSet(domains []string) map[string]bool {
+	if len(domains) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(domains))
+	for _, domain := range domains {
+		if ascii, err := idna.Lookup.ToASCII(domain); err == nil {
+			domain = ascii
+		}
+		set[normalizeDomain(domain)] = true
+	}
+	return set
+}
+
+// normalizeDomain lowercases a domain and removes a trailing dot, so that
+// equivalent forms of a domain compare equal.
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
@@ -0,0 +1,45 @@
+package portier_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/portier/portier-go"
+)
+
+func TestDeniedDomains(t *testing.T) {
+	_, client := newTestClient(t, func(cfg *portier.Config) {
+		cfg.DeniedDomains = []string{"evil.com", "Other.Example."}
+	})
+
+	for _, email := range []string{
+		"a@evil.com",
+		"a@EVIL.com",
+		"a@evil.com.",
+		"a@other.example",
+		"a@OTHER.EXAMPLE.",
+	} {
+		if _, err := client.StartAuth(email); !errors.Is(err, portier.ErrEmailNotAllowed) {
+			t.Errorf("%s: got %v, want ErrEmailNotAllowed", email, err)
+		}
+	}
+
+	if _, err := client.StartAuth("a@example.com"); err != nil {
+		t.Errorf("a@example.com: %s", err)
+	}
+}
+
+func TestAllowedDomains(t *testing.T) {
+	_, client := newTestClient(t, func(cfg *portier.Config) {
+		cfg.AllowedDomains = []string{"example.com"}
+	})
+
+	for _, email := range []string{"a@example.com", "a@EXAMPLE.com", "a@example.com."} {
+		if _, err := client.StartAuth(email); err != nil {
+			t.Errorf("%s: %s", email, err)
+		}
+	}
+	if _, err := client.StartAuth("a@evil.com."); !errors.Is(err, portier.ErrEmailNotAllowed) {
+		t.Errorf("a@evil.com.: got %v, want ErrEmailNotAllowed", err)
+	}
+}
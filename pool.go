@@ -0,0 +1,88 @@
+package portier
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ClientPool lazily creates and caches a Client per host, for applications
+// serving multiple domains, each of which is its own Portier client. All
+// Clients in the pool share a Store, unless the Config specifies one.
+//
+// A ClientPool is safe for concurrent use by multiple goroutines.
+type ClientPool interface {
+	// Client returns the Client for the host, creating it if necessary.
+	Client(host string) (Client, error)
+
+	// ClientForRequest returns the Client for the Host header of the request.
+	ClientForRequest(r *http.Request) (Client, error)
+}
+
+// ConfigFunc returns the Config for a host in a ClientPool. It is called once
+// per host, the first time a Client is requested for it. It should return an
+// error for unknown hosts, so that arbitrary Host headers don't grow the pool.
+type ConfigFunc func(host string) (*Config, error)
+
+type clientPool struct {
+	store     Store
+	configure ConfigFunc
+
+	lock    sync.Mutex
+	clients map[string]Client
+}
+
+// NewClientPool creates a ClientPool. The configure function provides the
+// Config for each host, including per-host overrides. Configs without a Store
+// get the shared store. If store is nil, an in-memory store is created.
+//
+// A typical configure function allows a fixed set of hosts:
+//
+//	func(host string) (*portier.Config, error) {
+//		if !tenants[host] {
+//			return nil, fmt.Errorf("unknown host: %s", host)
+//		}
+//		return &portier.Config{RedirectURI: "https://" + host + "/verify"}, nil
+//	}
+func NewClientPool(store Store, configure ConfigFunc) ClientPool {
+	if store == nil {
+		store = NewMemoryStore(&http.Client{Timeout: DefaultHTTPTimeout})
+	}
+	return &clientPool{
+		store:     store,
+		configure: configure,
+		clients:   make(map[string]Client),
+	}
+}
+
+func (pool *clientPool) Client(host string) (Client, error) {
+	host = strings.ToLower(host)
+
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	if client, ok := pool.clients[host]; ok {
+		return client, nil
+	}
+
+	cfg, err := pool.configure(host)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Store == nil {
+		withStore := *cfg
+		withStore.Store = pool.store
+		cfg = &withStore
+	}
+
+	client, err := NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	pool.clients[host] = client
+	return client, nil
+}
+
+func (pool *clientPool) ClientForRequest(r *http.Request) (Client, error) {
+	return pool.Client(r.Host)
+}
@@ -0,0 +1,12 @@
+// Package portierhttp provides ready-made net/http handlers for Portier
+// authentication, built on top of a portier.Client.
+//
+// A typical integration registers a LoginHandler, which receives a form with
+// the email address of the user, and a CallbackHandler on the RedirectURI of
+// the Client, which calls the application when the login succeeds.
+//
+// For applications that do not manage sessions themselves, LoginSuccess
+// stores the verified email address using a SessionBackend, and RequireLogin
+// protects routes by checking for a session. The default SessionBackend is
+// CookieSession, which uses a signed cookie.
+package portierhttp
@@ -0,0 +1,181 @@
+package portierhttp
+
+import (
+	"embed"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/portier/portier-go"
+)
+
+//go:embed templates/*.html
+var defaultTemplates embed.FS
+
+// TemplateData is passed to the templates rendered by LoginFlow.
+type TemplateData struct {
+	Next  string // URL to return to after login
+	Error string // Error message, if any
+}
+
+// LoginFlow is an http.Handler implementing a complete login flow: it serves
+// an email login form, starts authentication, verifies the callback, stores
+// the session in a cookie, and redirects back to the application.
+//
+// LoginFlow handles the following paths, and should be mounted using
+// http.StripPrefix, for example on `/auth/`:
+//
+//	GET  /        Login form
+//	POST /login   Start authentication
+//	POST /verify  Callback from the broker
+//	GET  /verify  Callback from the broker in fragment mode
+//	POST /logout  Clear the session
+//
+// The RedirectURI of the Client must point to the verify path, for example
+// `https://example.com/auth/verify`. Both response modes are supported; in
+// fragment mode, the verify path serves portier.FragmentHandler.
+//
+// Use NewLoginFlow to create a LoginFlow with the default CookieSession.
+// Protect application routes using RequireLogin with the same Session, and the
+// login form as the login URL.
+type LoginFlow struct {
+	Client  portier.Client
+	Session SessionBackend
+
+	// Templates optionally overrides the built-in templates. It must contain a
+	// `login.html` and an `error.html` template, which receive TemplateData.
+	Templates fs.FS
+
+	// OnLogin is optionally called after verification, before the session is
+	// stored. Returning an error aborts the login, and shows the error page.
+	OnLogin func(r *http.Request, result *portier.VerifyResult) error
+
+	// LogoutURL is where the user is redirected after logging out. The default
+	// is the login form, at the path the LoginFlow is mounted on.
+	LogoutURL string
+
+	once      sync.Once
+	templates *template.Template
+	err       error
+}
+
+// NewLoginFlow creates a LoginFlow for the client, which stores sessions in a
+// CookieSession signed with the secret. The secret must be at least
+// MinSecretSize random bytes. Other fields of the LoginFlow, including the
+// CookieSession, can be adjusted before use.
+func NewLoginFlow(client portier.Client, secret []byte) (*LoginFlow, error) {
+	if len(secret) < MinSecretSize {
+		return nil, errShortSecret
+	}
+
+	return &LoginFlow{
+		Client:  client,
+		Session: &CookieSession{Secret: secret},
+	}, nil
+}
+
+func (flow *LoginFlow) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flow.once.Do(flow.parseTemplates)
+	if flow.err != nil {
+		http.Error(w, "Invalid login templates", http.StatusInternalServerError)
+		return
+	}
+	if flow.Client == nil || flow.Session == nil {
+		http.Error(w, "Invalid login configuration", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/", "":
+		flow.render(w, http.StatusOK, "login.html", &TemplateData{
+			Next: r.FormValue(DefaultNextField),
+		})
+	case "/login":
+		handler := LoginHandler{Client: flow.Client, Error: flow.fail}
+		flow.post(w, r, &handler)
+	case "/verify":
+		handler := CallbackHandler{Client: flow.Client, Success: flow.success, Error: flow.fail}
+		portier.FragmentHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			flow.post(w, r, &handler)
+		})).ServeHTTP(w, r)
+	case "/logout":
+		flow.post(w, r, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := flow.Session.Clear(w, r); err != nil {
+				http.Error(w, "Session error", http.StatusInternalServerError)
+				return
+			}
+			target := flow.LogoutURL
+			if target == "" {
+				target = mountPath(r)
+			}
+			http.Redirect(w, r, target, http.StatusSeeOther)
+		}))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// mountPath returns the path the LoginFlow is mounted on, with a trailing
+// slash. It is the part of the request path removed by http.StripPrefix.
+func mountPath(r *http.Request) string {
+	requestURI, err := url.ParseRequestURI(r.RequestURI)
+	if err != nil || !strings.HasSuffix(requestURI.Path, r.URL.Path) {
+		return "/"
+	}
+	return strings.TrimSuffix(requestURI.Path, r.URL.Path) + "/"
+}
+
+func (flow *LoginFlow) parseTemplates() {
+	fsys := flow.Templates
+	if fsys == nil {
+		var err error
+		if fsys, err = fs.Sub(defaultTemplates, "templates"); err != nil {
+			flow.err = err
+			return
+		}
+	}
+
+	flow.templates, flow.err = template.ParseFS(fsys, "login.html", "error.html")
+}
+
+func (flow *LoginFlow) post(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	next.ServeHTTP(w, r)
+}
+
+func (flow *LoginFlow) render(w http.ResponseWriter, status int, name string, data *TemplateData) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	flow.templates.ExecuteTemplate(w, name, data)
+}
+
+func (flow *LoginFlow) success(w http.ResponseWriter, r *http.Request, result *portier.VerifyResult) {
+	if flow.OnLogin != nil {
+		if err := flow.OnLogin(r, result); err != nil {
+			flow.render(w, http.StatusForbidden, "error.html", &TemplateData{
+				Next:  result.Data,
+				Error: err.Error(),
+			})
+			return
+		}
+	}
+
+	LoginSuccess(flow.Session)(w, r, result)
+}
+
+func (flow *LoginFlow) fail(w http.ResponseWriter, r *http.Request, err error) {
+	status, msg := describeError(err)
+	flow.render(w, status, "error.html", &TemplateData{
+		Next:  r.FormValue(DefaultNextField),
+		Error: msg,
+	})
+}
@@ -0,0 +1,80 @@
+package portierhttp_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/portier/portier-go/portierhttp"
+	"github.com/portier/portier-go/portiertest"
+)
+
+func TestNewLoginFlowSecret(t *testing.T) {
+	client := portiertest.NewStubClient("user@example.com")
+	short := bytes.Repeat([]byte{1}, portierhttp.MinSecretSize-1)
+	if _, err := portierhttp.NewLoginFlow(client, short); err == nil {
+		t.Error("NewLoginFlow accepted a short secret")
+	}
+
+	flow, err := portierhttp.NewLoginFlow(client, bytes.Repeat([]byte{1}, portierhttp.MinSecretSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := flow.Session.(*portierhttp.CookieSession); !ok {
+		t.Errorf("unexpected default session: %T", flow.Session)
+	}
+}
+
+func TestLoginFlowWithoutSession(t *testing.T) {
+	flow := &portierhttp.LoginFlow{Client: portiertest.NewStubClient("user@example.com")}
+	w := httptest.NewRecorder()
+	flow.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/logout", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestLoginFlowFragmentCallback(t *testing.T) {
+	flow, err := portierhttp.NewLoginFlow(portiertest.NewStubClient("user@example.com"), bytes.Repeat([]byte{1}, portierhttp.MinSecretSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	flow.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/verify", nil))
+	if w.Code != http.StatusOK || !bytes.Contains(w.Body.Bytes(), []byte("location.hash")) {
+		t.Errorf("GET /verify did not serve the fragment page: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestLoginFlowLogoutRedirect(t *testing.T) {
+	flow, err := portierhttp.NewLoginFlow(portiertest.NewStubClient("user@example.com"), bytes.Repeat([]byte{1}, portierhttp.MinSecretSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/auth/", http.StripPrefix("/auth", flow))
+	mux.Handle("/", flow)
+
+	for path, want := range map[string]string{
+		"/auth/logout": "/auth/",
+		"/logout":      "/",
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, nil))
+		if w.Code != http.StatusSeeOther {
+			t.Errorf("POST %s: got status %d, want %d", path, w.Code, http.StatusSeeOther)
+		}
+		if location := w.Header().Get("Location"); location != want {
+			t.Errorf("POST %s: got redirect to %q, want %q", path, location, want)
+		}
+	}
+
+	flow.LogoutURL = "/goodbye"
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/auth/logout", nil))
+	if location := w.Header().Get("Location"); location != "/goodbye" {
+		t.Errorf("got redirect to %q, want /goodbye", location)
+	}
+}
@@ -0,0 +1,150 @@
+package portierhttp
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/portier/portier-go"
+)
+
+// DefaultEmailField is the default form field LoginHandler reads the email
+// address from.
+const DefaultEmailField = "email"
+
+// ErrorFunc is called by the handlers in this package when a request fails.
+// It is expected to write a response.
+type ErrorFunc func(w http.ResponseWriter, r *http.Request, err error)
+
+// SuccessFunc is called by CallbackHandler when a login completes. It is
+// expected to establish a session for the user and write a response, usually
+// a redirect.
+type SuccessFunc func(w http.ResponseWriter, r *http.Request, result *portier.VerifyResult)
+
+// LoginHandler starts authentication for the email address submitted in a
+// POST form, and redirects the user agent to the broker. Other methods are
+// rejected, so a third-party site can't start a login using a link or image.
+//
+// If the form also contains a `next` field, it is attached to the session
+// using portier.WithData, so it is available in the VerifyResult. If the Store
+// of the client does not implement portier.SessionStore, the field is ignored.
+//
+// The IP address of the request is passed to the Config.RateLimiter of the
+// client using portier.WithRateLimitKey. Behind a reverse proxy, this is the
+// address of the proxy, unless the request was rewritten.
+type LoginHandler struct {
+	Client     portier.Client
+	EmailField string    // Form field containing the email, or DefaultEmailField
+	NextField  string    // Form field containing the return URL, or DefaultNextField
+	Error      ErrorFunc // Called on failure, or DefaultError if nil
+}
+
+func (h *LoginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	field := h.EmailField
+	if field == "" {
+		field = DefaultEmailField
+	}
+
+	email := r.PostFormValue(field)
+	if email == "" {
+		h.fail(w, r, errMissingEmail)
+		return
+	}
+
+	nextField := h.NextField
+	if nextField == "" {
+		nextField = DefaultNextField
+	}
+
+	var options []portier.AuthOption
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		options = append(options, portier.WithRateLimitKey(host))
+	}
+	next := r.PostFormValue(nextField)
+
+	authURL, err := h.Client.StartAuth(email, append(options, portier.WithData(next))...)
+	if errors.Is(err, portier.ErrSessionStoreRequired) {
+		authURL, err = h.Client.StartAuth(email, options...)
+	}
+	if err != nil {
+		h.fail(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, authURL, http.StatusSeeOther)
+}
+
+func (h *LoginHandler) fail(w http.ResponseWriter, r *http.Request, err error) {
+	if h.Error != nil {
+		h.Error(w, r, err)
+	} else {
+		DefaultError(w, r, err)
+	}
+}
+
+// CallbackHandler verifies the callback from the broker, and calls Success
+// with the result. It should be registered on the RedirectURI of the Client.
+//
+// For a Client using portier.ResponseModeFragment, wrap this handler using
+// portier.FragmentHandler.
+type CallbackHandler struct {
+	Client  portier.Client
+	Success SuccessFunc // Called when the login succeeds
+	Error   ErrorFunc   // Called on failure, or DefaultError if nil
+}
+
+func (h *CallbackHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	result, err := h.Client.VerifyRequest(r)
+	if err != nil {
+		if h.Error != nil {
+			h.Error(w, r, err)
+		} else {
+			DefaultError(w, r, err)
+		}
+		return
+	}
+
+	h.Success(w, r, result)
+}
+
+var errMissingEmail = errors.New("email address missing")
+
+// DefaultError is the ErrorFunc used when none is configured. It responds
+// with a plain text error message and a status code based on the error.
+func DefaultError(w http.ResponseWriter, r *http.Request, err error) {
+	status, msg := describeError(err)
+	http.Error(w, msg, status)
+}
+
+// describeError returns a status code and user-facing message for an error.
+func describeError(err error) (int, string) {
+	var brokerErr *portier.BrokerError
+	switch {
+	case errors.Is(err, errMissingEmail):
+		return http.StatusBadRequest, "Email address is required"
+	case errors.Is(err, portier.ErrBrokerUnreachable):
+		return http.StatusBadGateway, "Login service unavailable"
+	case errors.Is(err, portier.ErrBrokerUnavailable):
+		return http.StatusServiceUnavailable, "Login service unavailable"
+	case errors.Is(err, portier.ErrInvalidEmail):
+		return http.StatusBadRequest, "Invalid email address"
+	case errors.Is(err, portier.ErrEmailNotAllowed):
+		return http.StatusForbidden, "This email address is not allowed to log in"
+	case errors.Is(err, portier.ErrRateLimited):
+		return http.StatusTooManyRequests, "Too many login attempts, please try again later"
+	case errors.As(err, &brokerErr),
+		errors.Is(err, portier.ErrInvalidSession),
+		errors.Is(err, portier.ErrInvalidToken),
+		errors.Is(err, portier.ErrInvalidSignature),
+		errors.Is(err, portier.ErrTokenExpired):
+		return http.StatusBadRequest, "Login failed, please try again"
+	default:
+		return http.StatusInternalServerError, "Login failed"
+	}
+}
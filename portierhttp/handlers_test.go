@@ -0,0 +1,58 @@
+package portierhttp_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/portier/portier-go"
+	"github.com/portier/portier-go/portierhttp"
+	"github.com/portier/portier-go/portiertest"
+)
+
+func TestLoginHandlerRequiresPost(t *testing.T) {
+	handler := &portierhttp.LoginHandler{Client: portiertest.NewStubClient("user@example.com")}
+
+	req := httptest.NewRequest(http.MethodGet, "/login?email=user@example.com", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET login: got status %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+
+	// Query parameters are ignored in a POST.
+	req = httptest.NewRequest(http.MethodPost, "/login?email=user@example.com", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("POST login without form: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestLoginHandlerWithoutSessionStore(t *testing.T) {
+	broker := portiertest.NewBroker()
+	defer broker.Close()
+
+	cfg := broker.Config("https://app.test/verify")
+	// Hide the SessionStore methods of the memory store.
+	cfg.Store = struct{ portier.Store }{cfg.Store}
+	client, err := portier.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &portierhttp.LoginHandler{Client: client}
+
+	form := url.Values{"email": {"user@example.com"}, "next": {"/account"}}
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusSeeOther, w.Body)
+	}
+	if location := w.Header().Get("Location"); !strings.HasPrefix(location, broker.URL+"/auth?") {
+		t.Errorf("unexpected redirect: %s", location)
+	}
+}
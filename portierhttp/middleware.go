@@ -0,0 +1,120 @@
+package portierhttp
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/portier/portier-go"
+)
+
+// DefaultNextField is the default query parameter and form field used to pass
+// the URL to return to after login.
+const DefaultNextField = "next"
+
+type contextKey struct{}
+
+// EmailFromContext returns the verified email address stored in the context
+// by RequireLogin.
+func EmailFromContext(ctx context.Context) (string, bool) {
+	email, ok := ctx.Value(contextKey{}).(string)
+	return email, ok
+}
+
+// WithEmail returns a copy of ctx containing the verified email address, as
+// retrieved by EmailFromContext.
+func WithEmail(ctx context.Context, email string) context.Context {
+	return context.WithValue(ctx, contextKey{}, email)
+}
+
+// RequireLogin returns middleware that only allows requests with a valid
+// session to pass. The verified email address is available to the wrapped
+// handler via EmailFromContext.
+//
+// Other requests are redirected to loginURL, which should present a login
+// form that submits to a LoginHandler. The original URL is added to loginURL
+// as a `next` query parameter, which the login form should pass on. After the
+// login completes, LoginSuccess redirects back to it.
+func RequireLogin(session SessionBackend, loginURL string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			email, err := session.Get(r)
+			if err != nil {
+				http.Error(w, "Session error", http.StatusInternalServerError)
+				return
+			}
+			if email == "" {
+				RedirectToLogin(w, r, loginURL)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(WithEmail(r.Context(), email)))
+		})
+	}
+}
+
+// RedirectToLogin redirects the request to loginURL, adding the URL of the
+// request as the `next` query parameter.
+func RedirectToLogin(w http.ResponseWriter, r *http.Request, loginURL string) {
+	target, err := LoginURL(loginURL, r.URL.RequestURI())
+	if err != nil {
+		http.Error(w, "Invalid login URL", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+// LoginURL adds the URL to return to after login to loginURL, as the `next`
+// query parameter.
+func LoginURL(loginURL string, next string) (string, error) {
+	target, err := url.Parse(loginURL)
+	if err != nil {
+		return "", err
+	}
+
+	q := target.Query()
+	q.Set(DefaultNextField, next)
+	target.RawQuery = q.Encode()
+	return target.String(), nil
+}
+
+// LoginSuccess returns a SuccessFunc for CallbackHandler that stores the
+// verified email address in the session, and redirects to the URL that was
+// passed to LoginHandler in the `next` field, or the root path.
+func LoginSuccess(session SessionBackend) SuccessFunc {
+	return func(w http.ResponseWriter, r *http.Request, result *portier.VerifyResult) {
+		if err := session.Set(w, r, result.Email); err != nil {
+			http.Error(w, "Session error", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, NextURL(result), http.StatusSeeOther)
+	}
+}
+
+// NextURL returns the URL that was passed to LoginHandler in the `next` field,
+// if it is a local path, or the root path otherwise.
+func NextURL(result *portier.VerifyResult) string {
+	if isLocalPath(result.Data) {
+		return result.Data
+	}
+	return "/"
+}
+
+// isLocalPath checks whether a redirect target stays on the same origin, to
+// prevent open redirects. Browsers ignore tabs and newlines in URLs, and treat
+// backslashes as slashes, so targets containing those are rejected outright.
+func isLocalPath(target string) bool {
+	if strings.IndexFunc(target, func(r rune) bool {
+		return r <= ' ' || r == 0x7f || r == '\\'
+	}) >= 0 {
+		return false
+	}
+
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Opaque != "" {
+		return false
+	}
+	return strings.HasPrefix(target, "/") && !strings.HasPrefix(target, "//")
+}
@@ -0,0 +1,155 @@
+package portierhttp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults for CookieSession fields.
+const (
+	DefaultCookieName   = "portier_session"
+	DefaultCookieMaxAge = time.Duration(24) * time.Hour
+)
+
+// MinSecretSize is the minimum size of CookieSession.Secret in bytes.
+const MinSecretSize = 32
+
+var errShortSecret = fmt.Errorf("CookieSession.Secret must be at least %d bytes", MinSecretSize)
+
+// SessionBackend controls how the verified email address of the user is
+// persisted between requests by LoginSuccess, RequireLogin and LoginFlow.
+//
+// CookieSession is the default implementation, which needs no server-side
+// storage. Alternative implementations may store sessions in a database, such
+// as Redis or SQL, and only keep a session ID in a cookie.
+type SessionBackend interface {
+	// Get returns the email address of the session associated with the
+	// request. It returns an empty string if there is no valid session.
+	Get(r *http.Request) (string, error)
+
+	// Set starts a session for the email address, associated with the user
+	// agent that made the request.
+	Set(w http.ResponseWriter, r *http.Request, email string) error
+
+	// Clear ends the session associated with the request, if any.
+	Clear(w http.ResponseWriter, r *http.Request) error
+}
+
+// CookieSession is a SessionBackend that stores the verified email address of
+// the user in a cookie signed using HMAC-SHA256.
+//
+// The cookie is not encrypted, so the email address is readable by the user
+// agent. The only required field is Secret, which must be at least
+// MinSecretSize random bytes, and must be kept private. Get and Set return an
+// error if the Secret is too short.
+type CookieSession struct {
+	Secret   []byte        // Key used to sign cookies
+	Name     string        // Cookie name, or DefaultCookieName
+	MaxAge   time.Duration // Session lifespan, or DefaultCookieMaxAge
+	Path     string        // Cookie path, or "/"
+	Insecure bool          // Allow sending the cookie over plain HTTP
+}
+
+func (s *CookieSession) name() string {
+	if s.Name == "" {
+		return DefaultCookieName
+	}
+	return s.Name
+}
+
+func (s *CookieSession) path() string {
+	if s.Path == "" {
+		return "/"
+	}
+	return s.Path
+}
+
+func (s *CookieSession) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.Secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Get returns the email address stored in the session cookie of the request,
+// if the cookie is present, has a valid signature, and has not expired.
+func (s *CookieSession) Get(r *http.Request) (string, error) {
+	if len(s.Secret) < MinSecretSize {
+		return "", errShortSecret
+	}
+
+	cookie, err := r.Cookie(s.name())
+	if err != nil {
+		return "", nil
+	}
+
+	sep := strings.LastIndexByte(cookie.Value, '.')
+	if sep == -1 {
+		return "", nil
+	}
+	payload, sig := cookie.Value[:sep], cookie.Value[sep+1:]
+	if !hmac.Equal([]byte(sig), []byte(s.sign(payload))) {
+		return "", nil
+	}
+
+	sep = strings.IndexByte(payload, '.')
+	if sep == -1 {
+		return "", nil
+	}
+	expires, err := strconv.ParseInt(payload[:sep], 10, 64)
+	if err != nil || time.Now().Unix() >= expires {
+		return "", nil
+	}
+	email, err := base64.RawURLEncoding.DecodeString(payload[sep+1:])
+	if err != nil {
+		return "", nil
+	}
+
+	return string(email), nil
+}
+
+// Set writes a session cookie for the given email address to the response.
+func (s *CookieSession) Set(w http.ResponseWriter, r *http.Request, email string) error {
+	if len(s.Secret) < MinSecretSize {
+		return errShortSecret
+	}
+
+	maxAge := s.MaxAge
+	if maxAge == 0 {
+		maxAge = DefaultCookieMaxAge
+	}
+
+	expires := time.Now().Add(maxAge)
+	payload := strconv.FormatInt(expires.Unix(), 10) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(email))
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     s.name(),
+		Value:    payload + "." + s.sign(payload),
+		Path:     s.path(),
+		Expires:  expires,
+		MaxAge:   int(maxAge / time.Second),
+		Secure:   !s.Insecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// Clear writes a response cookie that removes the session cookie.
+func (s *CookieSession) Clear(w http.ResponseWriter, r *http.Request) error {
+	http.SetCookie(w, &http.Cookie{
+		Name:     s.name(),
+		Path:     s.path(),
+		MaxAge:   -1,
+		Secure:   !s.Insecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
@@ -0,0 +1,111 @@
+package portierhttp_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/portier/portier-go"
+	"github.com/portier/portier-go/portierhttp"
+)
+
+// sessionCookie sets a session for the email and returns the cookie.
+func sessionCookie(t *testing.T, session *portierhttp.CookieSession, email string) *http.Cookie {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	if err := session.Set(w, httptest.NewRequest(http.MethodGet, "/", nil), email); err != nil {
+		t.Fatal(err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got %d cookies, want 1", len(cookies))
+	}
+	return cookies[0]
+}
+
+func TestCookieSession(t *testing.T) {
+	secret := bytes.Repeat([]byte{1}, portierhttp.MinSecretSize)
+	session := &portierhttp.CookieSession{Secret: secret}
+	cookie := sessionCookie(t, session, "user@example.com")
+	if !cookie.Secure || !cookie.HttpOnly {
+		t.Errorf("cookie is not Secure and HttpOnly: %v", cookie)
+	}
+
+	payload := cookie.Value[:strings.LastIndexByte(cookie.Value, '.')]
+	otherEmail := sessionCookie(t, session, "other@example.com").Value
+	expired := sessionCookie(t, &portierhttp.CookieSession{Secret: secret, MaxAge: -time.Hour}, "user@example.com").Value
+	otherSecret := sessionCookie(t, &portierhttp.CookieSession{Secret: bytes.Repeat([]byte{2}, portierhttp.MinSecretSize)}, "user@example.com").Value
+
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"valid", cookie.Value, "user@example.com"},
+		{"tampered signature", cookie.Value[:len(cookie.Value)-2] + "AA", ""},
+		{"signature of other email", payload + otherEmail[strings.LastIndexByte(otherEmail, '.'):], ""},
+		{"tampered expiry", "9" + cookie.Value, ""},
+		{"expired", expired, ""},
+		{"other secret", otherSecret, ""},
+		{"no signature", payload, ""},
+		{"garbage", "garbage", ""},
+		{"empty", "", ""},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(&http.Cookie{Name: portierhttp.DefaultCookieName, Value: test.value})
+		got, err := session.Get(req)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCookieSessionShortSecret(t *testing.T) {
+	session := &portierhttp.CookieSession{Secret: bytes.Repeat([]byte{1}, portierhttp.MinSecretSize-1)}
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if err := session.Set(w, req, "user@example.com"); err == nil {
+		t.Error("Set accepted a short secret")
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Error("Set wrote a cookie with a short secret")
+	}
+	if _, err := session.Get(req); err == nil {
+		t.Error("Get accepted a short secret")
+	}
+}
+
+func TestNextURL(t *testing.T) {
+	tests := []struct {
+		next string
+		want string
+	}{
+		{"/account", "/account"},
+		{"/account?tab=1#top", "/account?tab=1#top"},
+		{"", "/"},
+		{"account", "/"},
+		{"//evil.example", "/"},
+		{"/\\evil.example", "/"},
+		{"\\\\evil.example", "/"},
+		{"/\t/evil.example", "/"},
+		{"/\n/evil.example", "/"},
+		{"/\x00", "/"},
+		{"/\x7f", "/"},
+		{" /account", "/"},
+		{"https://evil.example/", "/"},
+		{"javascript:alert(1)", "/"},
+		{"/%zz", "/"},
+	}
+	for _, test := range tests {
+		if got := portierhttp.NextURL(&portier.VerifyResult{Data: test.next}); got != test.want {
+			t.Errorf("NextURL(%q): got %q, want %q", test.next, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+// Package portiertest provides utilities for testing applications that use
+// the portier package, without network access to a real broker.
+package portiertest
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/portier/portier-go"
+)
+
+// DefaultTokenLifetime is the default lifetime of tokens signed by Broker.
+const DefaultTokenLifetime = time.Duration(10) * time.Minute
+
+// PromptEmail is the email address Broker.Complete logs in with if the
+// authentication URL has no login_hint, as if the user entered it at the
+// broker.
+const PromptEmail = "user@example.com"
+
+// Broker is a fake Portier broker running on an httptest.Server. It serves a
+// discovery document and key set, and signs id_tokens on demand.
+//
+// Typical use in a test:
+//
+//	broker := portiertest.NewBroker()
+//	defer broker.Close()
+//
+//	client, _ := portier.NewClient(broker.Config("https://app.test/verify"))
+//	authURL, _ := client.StartAuth("user@example.com")
+//	params, _ := broker.Complete(authURL)
+//	result, _ := client.VerifyCallback(params)
+type Broker struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	keys     []jwk.Key // signing keys, current key last
+	skew     time.Duration
+	lifetime time.Duration
+}
+
+// NewBroker starts a fake broker with a single RSA signing key. Use
+// RotateKeyWithAlgorithm to switch to a different key type. The caller
+// should call Close when finished, to shut it down.
+func NewBroker() *Broker {
+	broker := &Broker{lifetime: DefaultTokenLifetime}
+	if err := broker.RotateKey(); err != nil {
+		panic(fmt.Sprintf("portiertest: %s", err))
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", broker.serveDiscovery)
+	mux.HandleFunc("/jwks.json", broker.serveKeys)
+	mux.HandleFunc("/auth", broker.serveAuth)
+	broker.Server = httptest.NewServer(mux)
+	return broker
+}
+
+// Config returns a portier.Config for a Client using this broker.
+func (broker *Broker) Config(redirectURI string) *portier.Config {
+	return &portier.Config{
+		Store:       portier.NewMemoryStore(broker.Client()),
+		Broker:      broker.URL,
+		RedirectURI: redirectURI,
+	}
+}
+
+// RotateKey generates a new RSA signing key. The previous keys remain in the
+// key set, until removed using RetireKeys.
+func (broker *Broker) RotateKey() error {
+	return broker.RotateKeyWithAlgorithm(jwa.RS256)
+}
+
+// RotateKeyWithAlgorithm is like RotateKey, but generates a key for the given
+// signing algorithm. Supported are jwa.RS256 and jwa.EdDSA (Ed25519).
+func (broker *Broker) RotateKeyWithAlgorithm(alg jwa.SignatureAlgorithm) error {
+	var raw crypto.Signer
+	var err error
+	switch alg {
+	case jwa.RS256:
+		raw, err = rsa.GenerateKey(rand.Reader, 2048)
+	case jwa.EdDSA:
+		_, raw, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return fmt.Errorf("unsupported algorithm: %s", alg)
+	}
+	if err != nil {
+		return err
+	}
+	key, err := jwk.FromRaw(raw)
+	if err != nil {
+		return err
+	}
+
+	kid := make([]byte, 8)
+	if _, err := rand.Read(kid); err != nil {
+		return err
+	}
+	key.Set(jwk.KeyIDKey, hex.EncodeToString(kid))
+	key.Set(jwk.AlgorithmKey, alg)
+	key.Set(jwk.KeyUsageKey, jwk.ForSignature)
+
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	broker.keys = append(broker.keys, key)
+	return nil
+}
+
+// RetireKeys removes all but the current signing key from the key set.
+func (broker *Broker) RetireKeys() {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	broker.keys = broker.keys[len(broker.keys)-1:]
+}
+
+// SetClockSkew sets an offset applied to the time claims of new tokens, to
+// simulate a broker with a skewed clock.
+func (broker *Broker) SetClockSkew(skew time.Duration) {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	broker.skew = skew
+}
+
+// SetTokenLifetime sets the lifetime of new tokens. The default is
+// DefaultTokenLifetime. A negative lifetime creates expired tokens.
+func (broker *Broker) SetTokenLifetime(lifetime time.Duration) {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	broker.lifetime = lifetime
+}
+
+// Sign signs a token with the current key. The iss, iat and exp claims are
+// added, unless present in claims.
+func (broker *Broker) Sign(claims map[string]interface{}) (string, error) {
+	broker.mu.Lock()
+	key := broker.keys[len(broker.keys)-1]
+	now := time.Now().Add(broker.skew)
+	lifetime := broker.lifetime
+	broker.mu.Unlock()
+
+	token := jwt.New()
+	token.Set(jwt.IssuerKey, broker.URL)
+	token.Set(jwt.IssuedAtKey, now)
+	token.Set(jwt.ExpirationKey, now.Add(lifetime))
+	for name, value := range claims {
+		if err := token.Set(name, value); err != nil {
+			return "", err
+		}
+	}
+
+	signed, err := jwt.Sign(token, jwt.WithKey(key.Algorithm(), key))
+	if err != nil {
+		return "", err
+	}
+	return string(signed), nil
+}
+
+// Token signs a token for a login of the email address, as the broker would
+// after the user completes authentication.
+func (broker *Broker) Token(email string, nonce string, audience string) (string, error) {
+	return broker.Sign(map[string]interface{}{
+		jwt.AudienceKey:  audience,
+		jwt.SubjectKey:   email,
+		"email":          email,
+		"email_original": email,
+		"nonce":          nonce,
+	})
+}
+
+// Complete takes an authentication URL returned by Client.StartAuth, and
+// returns the callback parameters the broker would send to the redirect URI
+// after the user completes authentication.
+func (broker *Broker) Complete(authURL string) (url.Values, error) {
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		return nil, err
+	}
+	q := parsed.Query()
+
+	email := q.Get("login_hint")
+	if email == "" {
+		email = PromptEmail
+	}
+	tokenStr, err := broker.Token(email, q.Get("nonce"), q.Get("client_id"))
+	if err != nil {
+		return nil, err
+	}
+
+	params := url.Values{"id_token": {tokenStr}}
+	if state := q.Get("state"); state != "" {
+		params.Set("state", state)
+	}
+	return params, nil
+}
+
+func (broker *Broker) serveDiscovery(w http.ResponseWriter, r *http.Request) {
+	broker.mu.Lock()
+	var algs []string
+	seen := make(map[string]bool)
+	for _, key := range broker.keys {
+		if alg := key.Algorithm().String(); !seen[alg] {
+			seen[alg] = true
+			algs = append(algs, alg)
+		}
+	}
+	broker.mu.Unlock()
+
+	writeJSON(w, map[string]interface{}{
+		"issuer":                                broker.URL,
+		"authorization_endpoint":                broker.URL + "/auth",
+		"jwks_uri":                              broker.URL + "/jwks.json",
+		"scopes_supported":                      []string{"openid", "email"},
+		"claims_supported":                      []string{"iss", "aud", "exp", "iat", "email"},
+		"response_types_supported":              []string{"id_token"},
+		"response_modes_supported":              []string{"form_post", "fragment"},
+		"grant_types_supported":                 []string{"implicit"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": algs,
+	})
+}
+
+func (broker *Broker) serveKeys(w http.ResponseWriter, r *http.Request) {
+	broker.mu.Lock()
+	set := jwk.NewSet()
+	for _, key := range broker.keys {
+		set.AddKey(key)
+	}
+	broker.mu.Unlock()
+
+	public, err := jwk.PublicSetOf(set)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, public)
+}
+
+// serveAuth immediately completes authentication, by posting the callback
+// parameters to the redirect URI using an auto-submitting form.
+func (broker *Broker) serveAuth(w http.ResponseWriter, r *http.Request) {
+	params, err := broker.Complete(r.URL.String())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	redirectURI := r.URL.Query().Get("redirect_uri")
+	if r.URL.Query().Get("response_mode") == portier.ResponseModeFragment {
+		http.Redirect(w, r, redirectURI+"#"+params.Encode(), http.StatusSeeOther)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, `<!DOCTYPE html><form method="post" action="%s">`, template.HTMLEscapeString(redirectURI))
+	for name := range params {
+		fmt.Fprintf(w, `<input type="hidden" name="%s" value="%s">`, template.HTMLEscapeString(name), template.HTMLEscapeString(params.Get(name)))
+	}
+	fmt.Fprint(w, `</form><script>document.forms[0].submit()</script>`)
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	json.NewEncoder(w).Encode(data)
+}
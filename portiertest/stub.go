@@ -0,0 +1,156 @@
+package portiertest
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/portier/portier-go"
+)
+
+// Values returned by StubClient.
+const (
+	// StubAuthURL is the URL returned by the default StubClient.StartAuth.
+	StubAuthURL = "https://broker.test/auth"
+
+	// StubBroker is the broker origin returned by StubClient.Broker.
+	StubBroker = "https://broker.test"
+
+	// StubRedirectURI is the redirect URI returned by StubClient.RedirectURI.
+	// Its origin is returned by StubClient.ClientID.
+	StubRedirectURI = "https://app.test/verify"
+)
+
+// StubClient is a portier.Client with scriptable results, for testing
+// application handlers without network access or a Store.
+//
+// The StartAuthFunc and VerifyFunc fields control the results. All Verify
+// variants are implemented in terms of VerifyFunc. Calls are recorded, and
+// available via Emails and Tokens.
+type StubClient struct {
+	StartAuthFunc func(email string, options ...portier.AuthOption) (string, error)
+	VerifyFunc    func(tokenStr string) (*portier.VerifyResult, error)
+
+	mu     sync.Mutex
+	emails []string
+	tokens []string
+}
+
+// NewStubClient returns a StubClient where StartAuth always succeeds, and
+// verification of any token succeeds for the given email address.
+func NewStubClient(email string) *StubClient {
+	return &StubClient{
+		StartAuthFunc: func(email string, options ...portier.AuthOption) (string, error) {
+			return StubAuthURL + "?" + url.Values{"login_hint": {email}}.Encode(), nil
+		},
+		VerifyFunc: func(tokenStr string) (*portier.VerifyResult, error) {
+			return &portier.VerifyResult{Email: email, EmailOriginal: email}, nil
+		},
+	}
+}
+
+// Emails returns the email addresses passed to StartAuth so far.
+func (client *StubClient) Emails() []string {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return append([]string(nil), client.emails...)
+}
+
+// Tokens returns the tokens passed to the Verify variants so far.
+func (client *StubClient) Tokens() []string {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return append([]string(nil), client.tokens...)
+}
+
+func (client *StubClient) StartAuth(email string, options ...portier.AuthOption) (string, error) {
+	client.mu.Lock()
+	client.emails = append(client.emails, email)
+	client.mu.Unlock()
+
+	return client.StartAuthFunc(email, options...)
+}
+
+func (client *StubClient) Verify(tokenStr string) (string, error) {
+	result, err := client.VerifyFull(tokenStr)
+	if err != nil {
+		return "", err
+	}
+	return result.Email, nil
+}
+
+func (client *StubClient) VerifyFull(tokenStr string) (*portier.VerifyResult, error) {
+	client.mu.Lock()
+	client.tokens = append(client.tokens, tokenStr)
+	client.mu.Unlock()
+
+	return client.VerifyFunc(tokenStr)
+}
+
+func (client *StubClient) ParseToken(tokenStr string) (*portier.VerifyResult, error) {
+	return client.VerifyFull(tokenStr)
+}
+
+func (client *StubClient) VerifyToken(tokenStr string) (jwt.Token, error) {
+	result, err := client.VerifyFull(tokenStr)
+	if err != nil {
+		return nil, err
+	}
+	return result.Token, nil
+}
+
+func (client *StubClient) VerifyCallback(params url.Values) (*portier.VerifyResult, error) {
+	if code := params.Get("error"); code != "" {
+		return nil, &portier.BrokerError{
+			Code:        code,
+			Description: params.Get("error_description"),
+			State:       params.Get("state"),
+		}
+	}
+
+	result, err := client.VerifyFull(params.Get("id_token"))
+	if err != nil {
+		return nil, err
+	}
+	if result.State == "" {
+		withState := *result
+		withState.State = params.Get("state")
+		result = &withState
+	}
+	return result, nil
+}
+
+func (client *StubClient) VerifyRequest(r *http.Request) (*portier.VerifyResult, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	return client.VerifyCallback(r.Form)
+}
+
+func (client *StubClient) ClientID() string {
+	return "https://app.test"
+}
+
+func (client *StubClient) Broker() string {
+	return StubBroker
+}
+
+func (client *StubClient) RedirectURI() string {
+	return StubRedirectURI
+}
+
+func (client *StubClient) Warmup() error {
+	return nil
+}
+
+func (client *StubClient) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (client *StubClient) Close() error {
+	return nil
+}
+
+var _ portier.Client = (*StubClient)(nil)
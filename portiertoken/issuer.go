@@ -0,0 +1,226 @@
+// Package portiertoken mints signed application tokens for users that
+// completed a Portier login, for example to hand a bearer token to a
+// single-page application right after the callback.
+//
+// Tokens are JWTs with the verified email address in the `sub` and `email`
+// claims. They are signed with a key controlled by the application, and are
+// unrelated to the id_token issued by the broker.
+package portiertoken
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/portier/portier-go"
+)
+
+// Defaults for Config fields. DefaultAlgorithm is used for symmetric keys;
+// for other keys, the default algorithm depends on the key type, see
+// Config.Algorithm.
+const (
+	DefaultAlgorithm = jwa.HS256
+	DefaultLifetime  = time.Duration(1) * time.Hour
+)
+
+// MinKeySize is the minimum size in bytes of a symmetric Key, as used with the
+// default HS256 algorithm.
+const MinKeySize = 32
+
+// Config is used with NewIssuer to construct an Issuer.
+//
+// The only required field is Key. For other fields, NewIssuer will fall back
+// to defaults if they are zero.
+type Config struct {
+	// Key is the signing key, in any form accepted by jwk.FromRaw. For the
+	// default HS256 algorithm, this is a []byte of at least MinKeySize random
+	// bytes.
+	Key interface{}
+
+	// Algorithm is the signing algorithm, which must match the type of Key.
+	// If not set, it is DefaultAlgorithm for a symmetric key, RS256 for an
+	// RSA key, ES256, ES384 or ES512 for an EC key depending on the curve,
+	// and EdDSA for an Ed25519 key.
+	Algorithm jwa.SignatureAlgorithm
+
+	Lifetime time.Duration // Token lifetime
+	Issuer   string        // Value of the iss claim, if not empty
+	Audience []string      // Value of the aud claim, if not empty
+
+	// Claims is optionally called to add custom claims to each token.
+	Claims func(result *portier.VerifyResult) (map[string]interface{}, error)
+}
+
+// Issuer mints and validates application tokens.
+//
+// An Issuer is safe for concurrent use by multiple goroutines.
+type Issuer interface {
+	// Issue returns a signed token for the user of a verified login.
+	Issue(result *portier.VerifyResult) (string, error)
+
+	// Parse validates a token created by Issue, and returns the parsed token.
+	// The verified email address is in the subject of the token.
+	Parse(tokenStr string) (jwt.Token, error)
+}
+
+type issuer struct {
+	key       jwk.Key
+	publicKey jwk.Key
+	algorithm jwa.SignatureAlgorithm
+	lifetime  time.Duration
+	issuer    string
+	audience  []string
+	claims    func(result *portier.VerifyResult) (map[string]interface{}, error)
+}
+
+// NewIssuer constructs an Issuer from a Config.
+func NewIssuer(cfg *Config) (Issuer, error) {
+	issuer := &issuer{
+		algorithm: cfg.Algorithm,
+		lifetime:  cfg.Lifetime,
+		issuer:    cfg.Issuer,
+		audience:  cfg.Audience,
+		claims:    cfg.Claims,
+	}
+
+	if issuer.lifetime == 0 {
+		issuer.lifetime = DefaultLifetime
+	}
+
+	if cfg.Key == nil {
+		return nil, fmt.Errorf("Key not set")
+	}
+	key, err := jwk.FromRaw(cfg.Key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+	issuer.key = key
+
+	algorithms, err := keyAlgorithms(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+	if issuer.algorithm == "" {
+		issuer.algorithm = algorithms[0]
+	} else if !containsAlgorithm(algorithms, issuer.algorithm) {
+		return nil, fmt.Errorf("algorithm %s can't be used with a %s key", issuer.algorithm, key.KeyType())
+	}
+
+	if key.KeyType() == jwa.OctetSeq {
+		var secret []byte
+		if err := key.Raw(&secret); err != nil {
+			return nil, fmt.Errorf("invalid key: %w", err)
+		}
+		if len(secret) < MinKeySize {
+			return nil, fmt.Errorf("invalid key: must be at least %d bytes", MinKeySize)
+		}
+		issuer.publicKey = key
+	} else if issuer.publicKey, err = jwk.PublicKeyOf(key); err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+
+	return issuer, nil
+}
+
+// keyAlgorithms returns the signing algorithms that can be used with the key,
+// the default first.
+func keyAlgorithms(key jwk.Key) ([]jwa.SignatureAlgorithm, error) {
+	switch key := key.(type) {
+	case jwk.SymmetricKey:
+		return []jwa.SignatureAlgorithm{DefaultAlgorithm, jwa.HS384, jwa.HS512}, nil
+	case jwk.RSAPrivateKey, jwk.RSAPublicKey:
+		return []jwa.SignatureAlgorithm{jwa.RS256, jwa.RS384, jwa.RS512, jwa.PS256, jwa.PS384, jwa.PS512}, nil
+	case jwk.ECDSAPrivateKey:
+		return ecdsaAlgorithms(key.Crv())
+	case jwk.ECDSAPublicKey:
+		return ecdsaAlgorithms(key.Crv())
+	case jwk.OKPPrivateKey:
+		return okpAlgorithms(key.Crv())
+	case jwk.OKPPublicKey:
+		return okpAlgorithms(key.Crv())
+	}
+	return nil, fmt.Errorf("unsupported key type: %s", key.KeyType())
+}
+
+func ecdsaAlgorithms(crv jwa.EllipticCurveAlgorithm) ([]jwa.SignatureAlgorithm, error) {
+	switch crv {
+	case jwa.P256:
+		return []jwa.SignatureAlgorithm{jwa.ES256}, nil
+	case jwa.P384:
+		return []jwa.SignatureAlgorithm{jwa.ES384}, nil
+	case jwa.P521:
+		return []jwa.SignatureAlgorithm{jwa.ES512}, nil
+	}
+	return nil, fmt.Errorf("unsupported curve: %s", crv)
+}
+
+func okpAlgorithms(crv jwa.EllipticCurveAlgorithm) ([]jwa.SignatureAlgorithm, error) {
+	if crv == jwa.Ed25519 {
+		return []jwa.SignatureAlgorithm{jwa.EdDSA}, nil
+	}
+	return nil, fmt.Errorf("unsupported curve: %s", crv)
+}
+
+func containsAlgorithm(algorithms []jwa.SignatureAlgorithm, algorithm jwa.SignatureAlgorithm) bool {
+	for _, candidate := range algorithms {
+		if candidate == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
+func (issuer *issuer) Issue(result *portier.VerifyResult) (string, error) {
+	now := time.Now()
+	builder := jwt.NewBuilder().
+		Subject(result.Email).
+		IssuedAt(now).
+		Expiration(now.Add(issuer.lifetime)).
+		Claim("email", result.Email)
+	if issuer.issuer != "" {
+		builder = builder.Issuer(issuer.issuer)
+	}
+	if len(issuer.audience) != 0 {
+		builder = builder.Audience(issuer.audience)
+	}
+
+	if issuer.claims != nil {
+		claims, err := issuer.claims(result)
+		if err != nil {
+			return "", err
+		}
+		for name, value := range claims {
+			builder = builder.Claim(name, value)
+		}
+	}
+
+	token, err := builder.Build()
+	if err != nil {
+		return "", fmt.Errorf("could not build token: %w", err)
+	}
+
+	signed, err := jwt.Sign(token, jwt.WithKey(issuer.algorithm, issuer.key))
+	if err != nil {
+		return "", fmt.Errorf("could not sign token: %w", err)
+	}
+
+	return string(signed), nil
+}
+
+func (issuer *issuer) Parse(tokenStr string) (jwt.Token, error) {
+	options := []jwt.ParseOption{
+		jwt.WithKey(issuer.algorithm, issuer.publicKey),
+		jwt.WithValidate(true),
+		jwt.WithRequiredClaim(jwt.SubjectKey),
+	}
+	if issuer.issuer != "" {
+		options = append(options, jwt.WithIssuer(issuer.issuer))
+	}
+	for _, aud := range issuer.audience {
+		options = append(options, jwt.WithAudience(aud))
+	}
+
+	return jwt.Parse([]byte(tokenStr), options...)
+}
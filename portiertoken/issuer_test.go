@@ -0,0 +1,89 @@
+package portiertoken_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/portier/portier-go"
+	"github.com/portier/portier-go/portiertoken"
+)
+
+func TestNewIssuerKeySize(t *testing.T) {
+	short := bytes.Repeat([]byte{1}, portiertoken.MinKeySize-1)
+	if _, err := portiertoken.NewIssuer(&portiertoken.Config{Key: short}); err == nil {
+		t.Errorf("NewIssuer accepted a %d byte key", len(short))
+	}
+
+	key := bytes.Repeat([]byte{1}, portiertoken.MinKeySize)
+	issuer, err := portiertoken.NewIssuer(&portiertoken.Config{Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenStr, err := issuer.Issue(&portier.VerifyResult{Email: "user@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := issuer.Parse(tokenStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Subject() != "user@example.com" {
+		t.Errorf("unexpected subject: %s", token.Subject())
+	}
+}
+
+func TestNewIssuerKeyTypes(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		key      interface{}
+		wrongAlg jwa.SignatureAlgorithm
+	}{
+		{"HMAC", bytes.Repeat([]byte{1}, portiertoken.MinKeySize), jwa.RS256},
+		{"RSA", rsaKey, jwa.HS256},
+		{"EC P-256", p256Key, jwa.ES384},
+		{"EC P-384", p384Key, jwa.ES256},
+		{"Ed25519", edKey, jwa.ES256},
+	}
+	for _, test := range tests {
+		issuer, err := portiertoken.NewIssuer(&portiertoken.Config{Key: test.key})
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		tokenStr, err := issuer.Issue(&portier.VerifyResult{Email: "user@example.com"})
+		if err != nil {
+			t.Errorf("%s: Issue: %s", test.name, err)
+			continue
+		}
+		if _, err := issuer.Parse(tokenStr); err != nil {
+			t.Errorf("%s: Parse: %s", test.name, err)
+		}
+
+		if _, err := portiertoken.NewIssuer(&portiertoken.Config{Key: test.key, Algorithm: test.wrongAlg}); err == nil {
+			t.Errorf("%s: NewIssuer accepted algorithm %s", test.name, test.wrongAlg)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package portier
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// recentResults remembers successful verifications for a short time, so that
+// a repeated callback with the same token returns the original result instead
+// of failing because the nonce was already consumed.
+type recentResults struct {
+	sync.Mutex
+	results map[[sha256.Size]byte]recentResult
+}
+
+type recentResult struct {
+	result  *VerifyResult
+	expires time.Time
+}
+
+// get returns the remembered result for the token, or nil.
+func (recent *recentResults) get(tokenStr string, now time.Time) *VerifyResult {
+	recent.Lock()
+	defer recent.Unlock()
+
+	entry, ok := recent.results[sha256.Sum256([]byte(tokenStr))]
+	if !ok || !now.Before(entry.expires) {
+		return nil
+	}
+	result := *entry.result
+	return &result
+}
+
+// add remembers the result for the token until expires, and removes expired
+// entries.
+func (recent *recentResults) add(tokenStr string, result *VerifyResult, now time.Time, expires time.Time) {
+	recent.Lock()
+	defer recent.Unlock()
+
+	for key, entry := range recent.results {
+		if !now.Before(entry.expires) {
+			delete(recent.results, key)
+		}
+	}
+	if recent.results == nil {
+		recent.results = make(map[[sha256.Size]byte]recentResult)
+	}
+	stored := *result
+	recent.results[sha256.Sum256([]byte(tokenStr))] = recentResult{&stored, expires}
+}
@@ -0,0 +1,123 @@
+package portier
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+// ReloadableClient is a Client whose configuration can be replaced while it is
+// in use, for example from a configuration file watcher.
+//
+// All Clients created by Reload share the Store of the initial Client, so
+// logins started before a Reload can still be completed after it, as long as
+// the RedirectURI origin (or one of the AdditionalAudiences) stays the same.
+//
+// A ReloadableClient is safe for concurrent use by multiple goroutines.
+type ReloadableClient interface {
+	Client
+
+	// Reload creates a new Client from the Config, and atomically replaces the
+	// current Client with it. The Store of the initial Client is kept, so the
+	// Store field of the Config is ignored, as are the fields used to create
+	// the default Store: HTTPClient, TLSConfig, Proxy, DialContext,
+	// NonceGenerator, MinCacheAge, MaxCacheAge and BrokerHeaders. If the
+	// Config is invalid, an error is returned and the current Client remains
+	// in use.
+	Reload(cfg *Config) error
+}
+
+type reloadableClient struct {
+	initial Client
+	store   Store
+	current atomic.Pointer[Client]
+}
+
+// NewReloadableClient constructs a ReloadableClient from an initial Config.
+func NewReloadableClient(cfg *Config) (ReloadableClient, error) {
+	initial, err := NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	reloadable := &reloadableClient{
+		initial: initial,
+		store:   initial.(*client).store,
+	}
+	reloadable.current.Store(&initial)
+	return reloadable, nil
+}
+
+func (reloadable *reloadableClient) Reload(cfg *Config) error {
+	copied := *cfg
+	copied.clearStoreFields()
+	copied.Store = reloadable.store
+
+	next, err := NewClient(&copied)
+	if err != nil {
+		return err
+	}
+	reloadable.current.Store(&next)
+	return nil
+}
+
+func (reloadable *reloadableClient) client() Client {
+	return *reloadable.current.Load()
+}
+
+func (reloadable *reloadableClient) StartAuth(email string, options ...AuthOption) (string, error) {
+	return reloadable.client().StartAuth(email, options...)
+}
+
+func (reloadable *reloadableClient) Verify(tokenStr string) (string, error) {
+	return reloadable.client().Verify(tokenStr)
+}
+
+func (reloadable *reloadableClient) VerifyFull(tokenStr string) (*VerifyResult, error) {
+	return reloadable.client().VerifyFull(tokenStr)
+}
+
+func (reloadable *reloadableClient) ParseToken(tokenStr string) (*VerifyResult, error) {
+	return reloadable.client().ParseToken(tokenStr)
+}
+
+func (reloadable *reloadableClient) VerifyToken(tokenStr string) (jwt.Token, error) {
+	return reloadable.client().VerifyToken(tokenStr)
+}
+
+func (reloadable *reloadableClient) VerifyCallback(params url.Values) (*VerifyResult, error) {
+	return reloadable.client().VerifyCallback(params)
+}
+
+func (reloadable *reloadableClient) VerifyRequest(r *http.Request) (*VerifyResult, error) {
+	return reloadable.client().VerifyRequest(r)
+}
+
+func (reloadable *reloadableClient) ClientID() string {
+	return reloadable.client().ClientID()
+}
+
+func (reloadable *reloadableClient) Broker() string {
+	return reloadable.client().Broker()
+}
+
+func (reloadable *reloadableClient) RedirectURI() string {
+	return reloadable.client().RedirectURI()
+}
+
+func (reloadable *reloadableClient) Warmup() error {
+	return reloadable.client().Warmup()
+}
+
+func (reloadable *reloadableClient) Ping(ctx context.Context) error {
+	return reloadable.client().Ping(ctx)
+}
+
+// Close closes the initial Client, which owns the Store if it was created by
+// default. Clients created by Reload hold no resources of their own.
+func (reloadable *reloadableClient) Close() error {
+	return reloadable.initial.Close()
+}
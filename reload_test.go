@@ -0,0 +1,55 @@
+package portier_test
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/portier/portier-go"
+	"github.com/portier/portier-go/portiertest"
+)
+
+func TestReloadSameConfig(t *testing.T) {
+	broker := portiertest.NewBroker()
+	defer broker.Close()
+
+	cfg := &portier.Config{
+		Broker:         broker.URL,
+		RedirectURI:    testRedirectURI,
+		HTTPClient:     broker.Client(),
+		MinCacheAge:    time.Minute,
+		MaxCacheAge:    time.Hour,
+		BrokerHeaders:  http.Header{"X-Api-Key": {"secret"}},
+		NonceGenerator: portier.Base64NonceGenerator(32),
+	}
+	client, err := portier.NewReloadableClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Reload(cfg); err != nil {
+		t.Fatalf("reloading the initial config: %s", err)
+	}
+
+	withTransport := *cfg
+	withTransport.HTTPClient = nil
+	withTransport.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	withTransport.Proxy = http.ProxyFromEnvironment
+	if err := client.Reload(&withTransport); err != nil {
+		t.Fatalf("reloading a config with transport settings: %s", err)
+	}
+
+	// The reloaded Client uses the Store of the initial Client.
+	authURL, err := client.StartAuth("user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, err := broker.Complete(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.VerifyCallback(params); err != nil {
+		t.Error(err)
+	}
+}
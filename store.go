@@ -1,13 +1,30 @@
 package portier
 
 import (
+	"container/list"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"net/http"
 	"reflect"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/lestrrat-go/option"
 )
 
+// DefaultNonceTTL is the default lifespan of nonces in the in-memory store.
+const DefaultNonceTTL = time.Duration(15) * time.Minute
+
+// nonceShards is the number of independently locked nonce maps in the
+// in-memory store, to reduce lock contention under load.
+const nonceShards = 32
+
 // Store is the backing store used by Client for two purposes:
 //
 // - to fetch JSON documents using HTTP GET with additional caching, and
@@ -22,7 +39,8 @@ type Store interface {
 	//
 	// Implementors should honor HTTP cache headers, with a sensibile minimum
 	// (and possibly maximum) applied to the cache lifespan. See SimpleFetch for
-	// a default fallback implementation that can be used on cache miss.
+	// a default fallback implementation that can be used on cache miss, or
+	// CoordinatedFetch if the cache is shared between processes.
 	//
 	// The Client calls this method with the data parameter set to a double
 	// pointer to a zero value of the type to unmarshal. The double pointer
@@ -47,6 +65,15 @@ type Store interface {
 	ConsumeNonce(nonce string, email string) error
 }
 
+// FetchContextStore is an optional interface a Store can implement to allow
+// cancelling fetches. The Client uses it in Ping, so that the check stops when
+// the context is done.
+type FetchContextStore interface {
+	// FetchContext is like Store.Fetch, but the request is cancelled when the
+	// context is done. The result of a cancelled request should not be cached.
+	FetchContext(ctx context.Context, url string, data interface{}) error
+}
+
 // InvalidNonce is returned by Store.ConsumeNonce when the nonce/email pair was
 // not found in the store.
 type InvalidNonce struct{}
@@ -55,21 +82,249 @@ func (*InvalidNonce) Error() string {
 	return "invalid nonce"
 }
 
+// SessionStore is an optional interface a Store can implement to keep
+// additional session data with each nonce. The Client uses it to record the
+// state given to StartAuth, so it can be validated on the callback, and the
+// client ID and redirect URI, so a session in a store shared by multiple
+// sites can only be completed by the site that started it.
+type SessionStore interface {
+	// NewSession is like Store.NewNonce, but additionally stores the session
+	// data with the nonce/email pair.
+	NewSession(email string, session *Session) (string, error)
+
+	// ConsumeSession is like Store.ConsumeNonce, but additionally returns the
+	// session data stored with the nonce/email pair.
+	ConsumeSession(nonce string, email string) (*Session, error)
+}
+
+// SessionTTLStore is an optional interface a SessionStore can implement to
+// allow the Client to choose the lifespan of each session. The Client uses it
+// if Config.SessionTTL is set.
+type SessionTTLStore interface {
+	// NewSessionTTL is like SessionStore.NewSession, but the nonce expires
+	// after the given time instead of the default for the store.
+	NewSessionTTL(email string, session *Session, ttl time.Duration) (string, error)
+}
+
+// TokenIDStore is an optional interface a Store can implement to record the
+// IDs (jti claims) of verified tokens. The Client uses it to reject replayed
+// tokens, if Config.CheckTokenID is set.
+type TokenIDStore interface {
+	// ConsumeTokenID records the token ID until the given expiry time. It
+	// returns false if the ID was already recorded and has not yet expired.
+	ConsumeTokenID(id string, expires time.Time) (bool, error)
+}
+
+// Session contains data stored with a nonce by a SessionStore.
+type Session struct {
+	State       string `json:"state,omitempty"`        // State given to StartAuth
+	Data        string `json:"data,omitempty"`         // Data given to StartAuth
+	ClientID    string `json:"client_id,omitempty"`    // Client that started the session
+	RedirectURI string `json:"redirect_uri,omitempty"` // Redirect URI sent to the broker
+	Broker      string `json:"broker,omitempty"`       // Broker the user was sent to
+}
+
+// MemoryStore is the Store implementation returned by NewMemoryStore. In
+// addition to the Store and SessionStore methods, it provides some
+// introspection.
+type MemoryStore interface {
+	Store
+	SessionStore
+	SessionTTLStore
+	TokenIDStore
+	FetchContextStore
+
+	// Stats returns a snapshot of the document cache statistics.
+	Stats() CacheStats
+
+	// SaveNonces writes all active nonces to w, so they can be restored with
+	// LoadNonces. This can be used to preserve in-flight logins across a
+	// graceful restart of the application.
+	//
+	// The output contains the nonces in plain text, and should be protected
+	// accordingly.
+	SaveNonces(w io.Writer) error
+
+	// LoadNonces reads nonces written by SaveNonces and adds them to the store.
+	// Nonces that have expired in the meantime are skipped.
+	LoadNonces(r io.Reader) error
+
+	// Close stops the background refreshes started for
+	// WithStaleWhileRevalidate, and waits for them to finish. The store can
+	// still be used afterwards, but expired documents are then refreshed
+	// before returning. Close always returns nil.
+	Close() error
+}
+
+// CacheStats contains statistics for the document cache of a MemoryStore.
+type CacheStats struct {
+	Entries   int    // Number of documents currently in the cache
+	Hits      uint64 // Number of fetches served from the cache
+	Misses    uint64 // Number of fetches of documents not in the cache
+	Refreshes uint64 // Number of fetches of expired documents
+
+	// Documents contains per-URL statistics of the documents currently in the
+	// cache.
+	Documents map[string]DocumentStats
+}
+
+// DocumentStats contains statistics for a single document in the cache of a
+// MemoryStore.
+type DocumentStats struct {
+	Hits        uint64    // Number of fetches served from the cache
+	Refreshes   uint64    // Number of fetches of the expired document
+	Expires     time.Time // When the cached copy expires
+	LastError   error     // The last error that occurred fetching the document
+	LastErrorAt time.Time // When the last error occurred
+	Stale       bool      // Whether an old copy is served after a failed refresh
+	Failures    int       // Number of consecutive failed fetches
+}
+
 type memoryStore struct {
 	*http.Client
 
-	cache     map[string]*cacheEntry
-	cacheLock sync.Mutex
+	cache      map[string]*list.Element
+	cacheOrder *list.List // of *cacheEntry, most recently used first
+	cacheLock  sync.Mutex
+	maxEntries int
+	hits       uint64
+	misses     uint64
+	refreshes  uint64
+
+	nonces   [nonceShards]nonceShard
+	nonceTTL time.Duration
+	random   io.Reader
+	generate NonceGenerator
+	now      func() time.Time
+
+	fetchOptions         []FetchOption
+	staleIfError         time.Duration
+	staleWhileRevalidate time.Duration
+	errorBackoff         time.Duration
+
+	background     sync.WaitGroup // running background refreshes
+	backgroundCtx  context.Context
+	stopBackground context.CancelFunc
+	closeLock      sync.Mutex
+	closed         bool
+}
+
+type nonceEntry struct {
+	expires time.Time
+	session *Session
+}
 
-	nonces     map[string]struct{}
-	noncesLock sync.Mutex
+// savedNonce is the model used for JSON encoding by SaveNonces.
+type savedNonce struct {
+	Pair    string    `json:"pair"`
+	Expires time.Time `json:"expires"`
+	Session *Session  `json:"session,omitempty"`
+}
+
+type nonceShard struct {
+	sync.Mutex
+	nonces    map[string]nonceEntry
+	tokenIDs  map[string]time.Time
+	lastSweep time.Time
 }
 
 type cacheEntry struct {
 	sync.Mutex
-	data    interface{}
-	err     error
-	expires time.Time
+	url        string
+	data       interface{}
+	err        error
+	expires    time.Time
+	stale      time.Time // until when data may be served if refreshing fails
+	validators CacheValidators
+	failures   int           // consecutive failed fetches
+	refreshing bool          // whether a background refresh is in progress
+	stats      DocumentStats // protected by memoryStore.cacheLock
+}
+
+// MemoryStoreOption is the interface for options accepted by NewMemoryStore.
+type MemoryStoreOption = option.Interface
+type identNonceTTL struct{}
+type identMaxCacheEntries struct{}
+type identRandom struct{}
+type identNonceGenerator struct{}
+type identClock struct{}
+type identFetchOptions struct{}
+type identStaleIfError struct{}
+type identStaleWhileRevalidate struct{}
+type identErrorBackoff struct{}
+
+// WithNonceTTL is used with NewMemoryStore to set how long nonces remain
+// valid. Nonces of sessions that were never completed are removed after this
+// time. The default is DefaultNonceTTL, which is also used if ttl is zero or
+// negative.
+func WithNonceTTL(ttl time.Duration) MemoryStoreOption {
+	return option.New(identNonceTTL{}, ttl)
+}
+
+// WithMaxCacheEntries is used with NewMemoryStore to limit the number of
+// documents kept in the cache. When the limit is reached, the least recently
+// used document is evicted. The default is zero, meaning no limit.
+func WithMaxCacheEntries(max int) MemoryStoreOption {
+	return option.New(identMaxCacheEntries{}, max)
+}
+
+// WithRandom is used with NewMemoryStore to set the source of random data for
+// nonces. The default is crypto/rand.Reader. See GenerateNonceFrom.
+//
+// The reader must be safe for concurrent use if the store is.
+func WithRandom(random io.Reader) MemoryStoreOption {
+	return option.New(identRandom{}, random)
+}
+
+// WithNonceGenerator is used with NewMemoryStore to set the format of nonces.
+// The default is GenerateNonceFrom, for 128-bit hex encoded nonces.
+//
+// It can also be used with NewClientWithOptions to set Config.NonceGenerator.
+func WithNonceGenerator(generate NonceGenerator) MemoryStoreOption {
+	return option.New(identNonceGenerator{}, generate)
+}
+
+// WithClock is used with NewMemoryStore to set the function used to get the
+// current time, for cache and nonce expiry. The default is time.Now.
+//
+// It can also be used with NewClientWithOptions to set Config.Clock.
+func WithClock(clock func() time.Time) MemoryStoreOption {
+	return option.New(identClock{}, clock)
+}
+
+// WithFetchOptions is used with NewMemoryStore to set options passed to
+// SimpleFetch when fetching documents, for example WithMaxResponseSize. It can
+// be given multiple times.
+func WithFetchOptions(options ...FetchOption) MemoryStoreOption {
+	return option.New(identFetchOptions{}, options)
+}
+
+// WithStaleIfError is used with NewMemoryStore to keep serving the last good
+// copy of a document for up to the given time past its expiry, if refreshing
+// it fails. Refreshes are retried during this time. This lets logins continue
+// during a brief broker outage, as long as the keys haven't changed. The
+// default is zero, meaning fetch errors are returned immediately.
+func WithStaleIfError(grace time.Duration) MemoryStoreOption {
+	return option.New(identStaleIfError{}, grace)
+}
+
+// WithStaleWhileRevalidate is used with NewMemoryStore to serve a document for
+// up to the given time past its expiry, while it is refreshed in the
+// background. This avoids having a request wait for the broker each time a
+// document expires. The default is zero, meaning expired documents are
+// refreshed before returning.
+func WithStaleWhileRevalidate(window time.Duration) MemoryStoreOption {
+	return option.New(identStaleWhileRevalidate{}, window)
+}
+
+// WithErrorBackoff is used with NewMemoryStore to double the cache lifespan of
+// errors for each consecutive failed fetch of a document, up to the given
+// maximum. This reduces load on a broker that is down for longer, while still
+// recovering quickly from brief failures. The initial lifespan is set by
+// WithErrorCacheAge, passed using WithFetchOptions. The default is zero,
+// meaning errors are always cached for the same time.
+func WithErrorBackoff(max time.Duration) MemoryStoreOption {
+	return option.New(identErrorBackoff{}, max)
 }
 
 // NewMemoryStore creates a Store that keeps everything in-memory. This is the
@@ -82,43 +337,115 @@ type cacheEntry struct {
 //
 // The in-memory store is safe for concurrent use by multiple goroutines.
 //
-// Note that the cache in this store only grows. This is fine, because it is
-// assumed the store is only used to periodically refresh a couple of documents
-// of the Portier broker.
+// By default, the cache in this store only grows. This is fine if the store is
+// only used to periodically refresh a couple of documents of the Portier
+// broker. If many Clients share the store and point at different brokers, set
+// a limit using WithMaxCacheEntries.
+//
+// Nonces expire after a configurable TTL (see WithNonceTTL). Expired nonces
+// are removed lazily, when new nonces are created.
 //
 // Note also that the in-memory store will only work as expected if there is
 // only one application process.
-func NewMemoryStore(httpClient *http.Client) Store {
-	return &memoryStore{
-		Client: httpClient,
-		cache:  make(map[string]*cacheEntry),
-		nonces: make(map[string]struct{}),
+func NewMemoryStore(httpClient *http.Client, options ...MemoryStoreOption) MemoryStore {
+	store := &memoryStore{
+		Client:     httpClient,
+		cache:      make(map[string]*list.Element),
+		cacheOrder: list.New(),
+		nonceTTL:   DefaultNonceTTL,
+		random:     rand.Reader,
+		generate:   GenerateNonceFrom,
+		now:        time.Now,
+	}
+	store.backgroundCtx, store.stopBackground = context.WithCancel(context.Background())
+
+	for _, option := range options {
+		switch option.Ident() {
+		case identNonceTTL{}:
+			if ttl := option.Value().(time.Duration); ttl > 0 {
+				store.nonceTTL = ttl
+			}
+		case identMaxCacheEntries{}:
+			store.maxEntries = option.Value().(int)
+		case identRandom{}:
+			store.random = option.Value().(io.Reader)
+		case identNonceGenerator{}:
+			store.generate = option.Value().(NonceGenerator)
+		case identClock{}:
+			store.now = option.Value().(func() time.Time)
+		case identFetchOptions{}:
+			store.fetchOptions = append(store.fetchOptions, option.Value().([]FetchOption)...)
+		case identStaleIfError{}:
+			store.staleIfError = option.Value().(time.Duration)
+		case identStaleWhileRevalidate{}:
+			store.staleWhileRevalidate = option.Value().(time.Duration)
+		case identErrorBackoff{}:
+			store.errorBackoff = option.Value().(time.Duration)
+		}
+	}
+
+	now := store.now()
+	for i := range store.nonces {
+		store.nonces[i].nonces = make(map[string]nonceEntry)
+		store.nonces[i].tokenIDs = make(map[string]time.Time)
+		store.nonces[i].lastSweep = now
 	}
+
+	return store
 }
 
 func (store *memoryStore) getCacheEntry(url string) *cacheEntry {
 	store.cacheLock.Lock()
 	defer store.cacheLock.Unlock()
 
-	if entry, ok := store.cache[url]; ok {
-		return entry
+	if elem, ok := store.cache[url]; ok {
+		store.cacheOrder.MoveToFront(elem)
+		return elem.Value.(*cacheEntry)
+	}
+
+	entry := &cacheEntry{url: url}
+	store.cache[url] = store.cacheOrder.PushFront(entry)
+
+	if store.maxEntries > 0 && store.cacheOrder.Len() > store.maxEntries {
+		oldest := store.cacheOrder.Back()
+		store.cacheOrder.Remove(oldest)
+		delete(store.cache, oldest.Value.(*cacheEntry).url)
 	}
 
-	entry := &cacheEntry{}
-	store.cache[url] = entry
 	return entry
 }
 
 func (store *memoryStore) Fetch(url string, data interface{}) error {
+	return store.FetchContext(context.Background(), url, data)
+}
+
+func (store *memoryStore) FetchContext(ctx context.Context, url string, data interface{}) error {
 	entry := store.getCacheEntry(url)
 	entry.Lock()
 	defer entry.Unlock()
 
-	if !time.Now().Before(entry.expires) {
-		entry.data = reflect.ValueOf(data).Elem().Interface() // take ownership
-		maxAge, err := SimpleFetch(store.Client, url, entry.data)
-		entry.err = err
-		entry.expires = time.Now().Add(maxAge)
+	now := store.now()
+	isNew := entry.expires.IsZero()
+	fresh := reflect.ValueOf(data).Elem().Interface() // take ownership
+	switch {
+	case now.Before(entry.expires):
+		store.recordHit(entry)
+	case !isNew && entry.err == nil && !entry.validators.MustRevalidate &&
+		now.Before(entry.expires.Add(store.staleWhileRevalidate)) && !store.isClosed():
+		// Serve the expired copy, and refresh it in the background.
+		if !entry.refreshing && store.startBackground() {
+			entry.refreshing = true
+			go store.revalidate(entry, fresh, entry.validators)
+		}
+		store.recordHit(entry)
+	default:
+		validators := entry.validators
+		maxAge, err := store.fetch(ctx, url, fresh, &validators)
+		if ctx.Err() != nil {
+			// Don't cache the failure of a cancelled request.
+			return err
+		}
+		store.install(entry, fresh, validators, maxAge, err, isNew)
 	}
 
 	if entry.err == nil {
@@ -128,27 +455,309 @@ func (store *memoryStore) Fetch(url string, data interface{}) error {
 	return entry.err
 }
 
+// revalidate refreshes an entry in the background. The entry is not locked
+// during the fetch, so the expired copy can be served meanwhile. The caller
+// must have called startBackground.
+func (store *memoryStore) revalidate(entry *cacheEntry, fresh interface{}, validators CacheValidators) {
+	defer store.background.Done()
+	maxAge, err := store.fetch(store.backgroundCtx, entry.url, fresh, &validators)
+
+	entry.Lock()
+	defer entry.Unlock()
+	entry.refreshing = false
+	if store.backgroundCtx.Err() != nil {
+		// Stopped by Close; the next Fetch refreshes the entry.
+		return
+	}
+	store.install(entry, fresh, validators, maxAge, err, false)
+}
+
+// startBackground registers a background refresh, and returns false if the
+// store is closed.
+func (store *memoryStore) startBackground() bool {
+	store.closeLock.Lock()
+	defer store.closeLock.Unlock()
+
+	if store.closed {
+		return false
+	}
+	store.background.Add(1)
+	return true
+}
+
+func (store *memoryStore) isClosed() bool {
+	store.closeLock.Lock()
+	defer store.closeLock.Unlock()
+
+	return store.closed
+}
+
+func (store *memoryStore) Close() error {
+	store.closeLock.Lock()
+	store.closed = true
+	store.closeLock.Unlock()
+
+	store.stopBackground()
+	store.background.Wait()
+	return nil
+}
+
+// fetch calls SimpleFetch with the store options, making a conditional
+// request if validators are set.
+func (store *memoryStore) fetch(ctx context.Context, url string, fresh interface{}, validators *CacheValidators) (time.Duration, error) {
+	options := append([]FetchOption{WithCacheValidators(validators), WithFetchClock(store.now)}, store.fetchOptions...)
+	return SimpleFetchContext(ctx, store.Client, url, fresh, options...)
+}
+
+// install updates an entry with the result of a fetch. If the document was
+// not modified, or the fetch failed within the WithStaleIfError grace period,
+// the previous copy is kept. The caller must hold the entry lock.
+func (store *memoryStore) install(entry *cacheEntry, fresh interface{}, validators CacheValidators, maxAge time.Duration, err error, isNew bool) {
+	now := store.now()
+	if err == nil || (errors.Is(err, ErrNotModified) && entry.err == nil && !isNew) {
+		if err == nil {
+			entry.data = fresh
+		}
+		entry.err = nil
+		entry.failures = 0
+		entry.validators = validators
+		entry.expires = now.Add(maxAge)
+		entry.stale = entry.expires.Add(store.staleIfError)
+		store.recordFetch(entry, isNew, nil, false)
+		return
+	}
+
+	entry.failures++
+	maxAge = store.backoff(maxAge, entry.failures)
+	entry.expires = now.Add(maxAge)
+	stale := !isNew && entry.err == nil && !entry.validators.MustRevalidate && now.Before(entry.stale)
+	if stale {
+		// Keep serving the last good copy, and retry after maxAge.
+		if entry.stale.Before(entry.expires) {
+			entry.expires = entry.stale
+		}
+	} else {
+		// Without a copy, a conditional request can't be answered with 304.
+		entry.data = nil
+		entry.err = err
+		entry.validators = CacheValidators{}
+	}
+	store.recordFetch(entry, isNew, err, stale)
+}
+
+// backoff scales the cache lifespan of an error with the number of
+// consecutive failures, according to WithErrorBackoff.
+func (store *memoryStore) backoff(maxAge time.Duration, failures int) time.Duration {
+	if store.errorBackoff <= maxAge {
+		return maxAge
+	}
+	for i := 1; i < failures && maxAge < store.errorBackoff; i++ {
+		maxAge *= 2
+	}
+	if maxAge > store.errorBackoff {
+		maxAge = store.errorBackoff
+	}
+	return maxAge
+}
+
+func (store *memoryStore) recordHit(entry *cacheEntry) {
+	store.cacheLock.Lock()
+	defer store.cacheLock.Unlock()
+
+	store.hits++
+	entry.stats.Hits++
+}
+
+func (store *memoryStore) recordFetch(entry *cacheEntry, isNew bool, err error, stale bool) {
+	store.cacheLock.Lock()
+	defer store.cacheLock.Unlock()
+
+	if isNew {
+		store.misses++
+	} else {
+		store.refreshes++
+		entry.stats.Refreshes++
+	}
+	entry.stats.Expires = entry.expires
+	entry.stats.Stale = stale
+	entry.stats.Failures = entry.failures
+	if err != nil {
+		entry.stats.LastError = err
+		entry.stats.LastErrorAt = store.now()
+	}
+}
+
+func (store *memoryStore) Stats() CacheStats {
+	store.cacheLock.Lock()
+	defer store.cacheLock.Unlock()
+
+	stats := CacheStats{
+		Entries:   len(store.cache),
+		Hits:      store.hits,
+		Misses:    store.misses,
+		Refreshes: store.refreshes,
+		Documents: make(map[string]DocumentStats, len(store.cache)),
+	}
+	for url, elem := range store.cache {
+		stats.Documents[url] = elem.Value.(*cacheEntry).stats
+	}
+	return stats
+}
+
+// nonceShard returns the shard responsible for the given nonce.
+func (store *memoryStore) nonceShard(nonce string) *nonceShard {
+	h := fnv.New32a()
+	h.Write([]byte(nonce))
+	return &store.nonces[h.Sum32()%nonceShards]
+}
+
 func (store *memoryStore) NewNonce(email string) (string, error) {
-	nonce := GenerateNonce()
+	return store.NewSession(email, nil)
+}
+
+func (store *memoryStore) NewSession(email string, session *Session) (string, error) {
+	return store.NewSessionTTL(email, session, store.nonceTTL)
+}
+
+func (store *memoryStore) NewSessionTTL(email string, session *Session, ttl time.Duration) (string, error) {
+	nonce, err := store.generate(store.random)
+	if err != nil {
+		return "", fmt.Errorf("nonce generator error: %w", err)
+	}
 	pair := fmt.Sprintf("%s:%s", nonce, email)
+	if ttl <= 0 {
+		ttl = store.nonceTTL
+	}
 
-	store.noncesLock.Lock()
-	defer store.noncesLock.Unlock()
+	shard := store.nonceShard(nonce)
+	shard.Lock()
+	defer shard.Unlock()
 
-	store.nonces[pair] = struct{}{}
+	now := store.now()
+	if now.Sub(shard.lastSweep) >= store.nonceTTL {
+		shard.sweep(now)
+	}
+
+	shard.nonces[pair] = nonceEntry{now.Add(ttl), session}
 	return nonce, nil
 }
 
+// sweep removes all expired nonces and token IDs. The caller must hold the
+// shard lock.
+func (shard *nonceShard) sweep(now time.Time) {
+	for pair, entry := range shard.nonces {
+		if !now.Before(entry.expires) {
+			delete(shard.nonces, pair)
+		}
+	}
+	for id, expires := range shard.tokenIDs {
+		if !now.Before(expires) {
+			delete(shard.tokenIDs, id)
+		}
+	}
+	shard.lastSweep = now
+}
+
 func (store *memoryStore) ConsumeNonce(nonce string, email string) error {
+	_, err := store.ConsumeSession(nonce, email)
+	return err
+}
+
+func (store *memoryStore) ConsumeSession(nonce string, email string) (*Session, error) {
 	pair := fmt.Sprintf("%s:%s", nonce, email)
 
-	store.noncesLock.Lock()
-	defer store.noncesLock.Unlock()
+	shard := store.nonceShard(nonce)
+	shard.Lock()
+	defer shard.Unlock()
+
+	entry, ok := shard.nonces[pair]
+	if !ok {
+		return nil, &InvalidNonce{}
+	}
+
+	delete(shard.nonces, pair)
+	if !store.now().Before(entry.expires) {
+		return nil, &InvalidNonce{}
+	}
+	if entry.session == nil {
+		return &Session{}, nil
+	}
+	return entry.session, nil
+}
+
+func (store *memoryStore) ConsumeTokenID(id string, expires time.Time) (bool, error) {
+	shard := store.nonceShard(id)
+	shard.Lock()
+	defer shard.Unlock()
+
+	now := store.now()
+	if now.Sub(shard.lastSweep) >= store.nonceTTL {
+		shard.sweep(now)
+	}
+
+	if prev, ok := shard.tokenIDs[id]; ok && now.Before(prev) {
+		return false, nil
+	}
+	shard.tokenIDs[id] = expires
+	return true, nil
+}
+
+func (store *memoryStore) SaveNonces(w io.Writer) error {
+	var saved []savedNonce
+	for i := range store.nonces {
+		shard := &store.nonces[i]
+		shard.Lock()
+		for pair, entry := range shard.nonces {
+			saved = append(saved, savedNonce{pair, entry.expires, entry.session})
+		}
+		shard.Unlock()
+	}
+
+	return json.NewEncoder(w).Encode(saved)
+}
+
+func (store *memoryStore) LoadNonces(r io.Reader) error {
+	var saved []savedNonce
+	if err := json.NewDecoder(r).Decode(&saved); err != nil {
+		return err
+	}
+
+	now := store.now()
+	for _, entry := range saved {
+		if !now.Before(entry.Expires) {
+			continue
+		}
+
+		sep := strings.IndexByte(entry.Pair, ':')
+		if sep == -1 {
+			return fmt.Errorf("invalid saved nonce: %s", entry.Pair)
+		}
 
-	if _, ok := store.nonces[pair]; !ok {
-		return &InvalidNonce{}
+		shard := store.nonceShard(entry.Pair[:sep])
+		shard.Lock()
+		shard.nonces[entry.Pair] = nonceEntry{entry.Expires, entry.Session}
+		shard.Unlock()
 	}
 
-	delete(store.nonces, pair)
 	return nil
 }
+
+// FetchLocker is an optional interface a Store can implement to coordinate
+// cache refreshes between multiple processes sharing the same cache.
+//
+// Without coordination, when the shared cache goes cold, every worker will
+// fetch the document from the broker at the same time. A Store implementing
+// FetchLocker can use CoordinatedFetch on cache miss, so that only the worker
+// holding the lock performs the request, while the others wait for the shared
+// cache to be filled.
+type FetchLocker interface {
+	// TryLockFetch attempts to acquire the refresh lock for the given URL. It
+	// returns false if another process currently holds the lock.
+	//
+	// Implementors must release the lock automatically after ttl, so a process
+	// that dies while holding the lock does not block refreshes forever.
+	TryLockFetch(url string, ttl time.Duration) (bool, error)
+
+	// UnlockFetch releases a lock acquired with TryLockFetch.
+	UnlockFetch(url string) error
+}
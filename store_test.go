@@ -0,0 +1,268 @@
+package portier
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreNonceTTL(t *testing.T) {
+	now := time.Now()
+	clock := func() time.Time { return now }
+
+	for _, ttl := range []time.Duration{0, -time.Minute} {
+		store := NewMemoryStore(&http.Client{}, WithNonceTTL(ttl), WithClock(clock))
+		nonce, err := store.NewNonce("user@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(DefaultNonceTTL - time.Second)
+		if err := store.ConsumeNonce(nonce, "user@example.com"); err != nil {
+			t.Errorf("WithNonceTTL(%s): nonce expired before DefaultNonceTTL: %s", ttl, err)
+		}
+	}
+
+	store := NewMemoryStore(&http.Client{}, WithNonceTTL(time.Minute), WithClock(clock))
+	nonce, err := store.NewNonce("user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Minute)
+	if err := store.ConsumeNonce(nonce, "user@example.com"); err == nil {
+		t.Error("nonce was accepted after it expired")
+	}
+}
+
+func TestMemoryStoreRevalidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		validator string
+		condition string
+		value     string
+	}{
+		{"ETag", "ETag", "If-None-Match", `"v1"`},
+		{"Last-Modified", "Last-Modified", "If-Modified-Since", "Mon, 02 Jan 2006 15:04:05 GMT"},
+	}
+	for _, test := range tests {
+		var full, notModified atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=600")
+			w.Header().Set(test.validator, test.value)
+			if r.Header.Get(test.condition) == test.value {
+				notModified.Add(1)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			full.Add(1)
+			fmt.Fprint(w, `{"value": "cached"}`)
+		}))
+
+		now := time.Now()
+		store := NewMemoryStore(srv.Client(), WithClock(func() time.Time { return now }))
+		fetch := func() {
+			t.Helper()
+			data, err := FetchAs[map[string]string](store, srv.URL)
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+			if (*data)["value"] != "cached" {
+				t.Errorf("%s: unexpected data: %v", test.name, *data)
+			}
+		}
+
+		fetch()
+		now = now.Add(10 * time.Minute)
+		fetch()
+		if full.Load() != 1 || notModified.Load() != 1 {
+			t.Errorf("%s: got %d full and %d conditional requests, want 1 and 1", test.name, full.Load(), notModified.Load())
+		}
+
+		// The 304 response extended the lifespan of the cached copy.
+		now = now.Add(5 * time.Minute)
+		fetch()
+		if full.Load() != 1 || notModified.Load() != 1 {
+			t.Errorf("%s: document was fetched before the extended lifespan ended", test.name)
+		}
+		srv.Close()
+	}
+}
+
+func TestMemoryStoreStaleIfError(t *testing.T) {
+	var down atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, `{"value": "cached"}`)
+	}))
+	defer srv.Close()
+
+	start := time.Now()
+	now := start
+	store := NewMemoryStore(srv.Client(), WithClock(func() time.Time { return now }), WithStaleIfError(10*time.Minute))
+	if _, err := FetchAs[map[string]string](store, srv.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	// During an outage, the expired copy is served within the grace period.
+	down.Store(true)
+	for _, elapsed := range []time.Duration{2 * time.Minute, 10 * time.Minute} {
+		now = start.Add(elapsed)
+		data, err := FetchAs[map[string]string](store, srv.URL)
+		if err != nil {
+			t.Fatalf("after %s: %s", elapsed, err)
+		}
+		if (*data)["value"] != "cached" {
+			t.Errorf("after %s: unexpected data: %v", elapsed, *data)
+		}
+		if stats := store.Stats().Documents[srv.URL]; !stats.Stale {
+			t.Errorf("after %s: document not reported as stale", elapsed)
+		}
+	}
+
+	// After the grace period, the error is returned.
+	now = start.Add(12 * time.Minute)
+	if _, err := FetchAs[map[string]string](store, srv.URL); err == nil {
+		t.Error("stale copy served after the grace period")
+	}
+}
+
+func TestMemoryStoreStaleWhileRevalidate(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) > 1 {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprintf(w, `{"value": "v%d"}`, requests.Load())
+	}))
+	defer srv.Close()
+
+	now := time.Now()
+	store := NewMemoryStore(srv.Client(), WithClock(func() time.Time { return now }), WithStaleWhileRevalidate(time.Hour))
+	fetch := func() string {
+		t.Helper()
+		data, err := FetchAs[map[string]string](store, srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return (*data)["value"]
+	}
+	fetch()
+
+	// Expired copies are served while a single refresh runs.
+	now = now.Add(2 * time.Minute)
+	for i := 0; i < 5; i++ {
+		if value := fetch(); value != "v1" {
+			t.Errorf("got %s during the refresh, want v1", value)
+		}
+	}
+	for requests.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Close stops the refresh, and waits for it.
+	store.Close()
+	if got := requests.Load(); got != 2 {
+		t.Errorf("got %d requests, want 2", got)
+	}
+	entry := store.(*memoryStore).getCacheEntry(srv.URL)
+	entry.Lock()
+	refreshing := entry.refreshing
+	entry.Unlock()
+	if refreshing {
+		t.Error("refresh still running after Close")
+	}
+
+	// After Close, expired documents are refreshed in the foreground.
+	close(release)
+	if value := fetch(); value != "v3" {
+		t.Errorf("got %s after Close, want v3", value)
+	}
+}
+
+func TestMemoryStoreRetryAfterDate(t *testing.T) {
+	// The clock of the store is far from the wall clock.
+	now := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", now.Add(2*time.Minute).UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	store := NewMemoryStore(srv.Client(), WithClock(func() time.Time { return now }))
+	if _, err := FetchAs[map[string]string](store, srv.URL); err == nil {
+		t.Fatal("fetch succeeded")
+	}
+	if expires := store.Stats().Documents[srv.URL].Expires; !expires.Equal(now.Add(2 * time.Minute)) {
+		t.Errorf("error cached until %s, want %s", expires, now.Add(2*time.Minute))
+	}
+}
+
+// singleLockNonces is a nonce store guarded by a single mutex, as the memory
+// store was before sharding, for comparison in benchmarks.
+type singleLockNonces struct {
+	sync.Mutex
+	nonces map[string]time.Time
+}
+
+func (store *singleLockNonces) NewNonce(email string) (string, error) {
+	nonce := GenerateNonce()
+	store.Lock()
+	defer store.Unlock()
+	store.nonces[fmt.Sprintf("%s:%s", nonce, email)] = time.Now().Add(DefaultNonceTTL)
+	return nonce, nil
+}
+
+func (store *singleLockNonces) ConsumeNonce(nonce string, email string) error {
+	pair := fmt.Sprintf("%s:%s", nonce, email)
+	store.Lock()
+	defer store.Unlock()
+	if _, ok := store.nonces[pair]; !ok {
+		return &InvalidNonce{}
+	}
+	delete(store.nonces, pair)
+	return nil
+}
+
+func BenchmarkMemoryStoreNonces(b *testing.B) {
+	type nonceStore interface {
+		NewNonce(email string) (string, error)
+		ConsumeNonce(nonce string, email string) error
+	}
+	stores := []struct {
+		name  string
+		store nonceStore
+	}{
+		{"sharded", NewMemoryStore(&http.Client{})},
+		{"single-lock", &singleLockNonces{nonces: make(map[string]time.Time)}},
+	}
+
+	for _, bench := range stores {
+		store := bench.store
+		b.Run(bench.name, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					nonce, err := store.NewNonce("user@example.com")
+					if err != nil {
+						b.Fatal(err)
+					}
+					if err := store.ConsumeNonce(nonce, "user@example.com"); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/portier/portier-go"
+)
+
+var (
+	errInjectedStore  = errors.New("injected store failure")
+	errInjectedBroker = errors.New("injected broker failure")
+)
+
+// faultStore wraps a store, and allows injecting failures using the `fault`
+// command of the tester protocol:
+//
+//	fault	store	on|off     all nonce operations fail
+//	fault	broker	on|off     all fetches fail, as if the broker is unreachable
+//	fault	expire             all existing nonces are treated as expired
+type faultStore struct {
+	inner portier.MemoryStore
+
+	mu           sync.Mutex
+	storeFailing bool
+	brokerDown   bool
+	expiredAt    time.Time
+	created      map[string]time.Time
+}
+
+func newFaultStore(inner portier.MemoryStore) *faultStore {
+	return &faultStore{
+		inner:   inner,
+		created: make(map[string]time.Time),
+	}
+}
+
+// inject handles the arguments of a `fault` command.
+func (store *faultStore) inject(args []string) bool {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	on := len(args) >= 2 && args[1] == "on"
+	switch {
+	case len(args) >= 1 && args[0] == "store":
+		store.storeFailing = on
+	case len(args) >= 1 && args[0] == "broker":
+		store.brokerDown = on
+	case len(args) >= 1 && args[0] == "expire":
+		store.expiredAt = time.Now()
+	default:
+		return false
+	}
+	return true
+}
+
+func (store *faultStore) Fetch(url string, data interface{}) error {
+	store.mu.Lock()
+	down := store.brokerDown
+	store.mu.Unlock()
+
+	if down {
+		return errInjectedBroker
+	}
+	return store.inner.Fetch(url, data)
+}
+
+func (store *faultStore) NewNonce(email string) (string, error) {
+	return store.NewSession(email, nil)
+}
+
+func (store *faultStore) NewSession(email string, session *portier.Session) (string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.storeFailing {
+		return "", errInjectedStore
+	}
+
+	var nonce string
+	var err error
+	if session == nil {
+		nonce, err = store.inner.NewNonce(email)
+	} else {
+		nonce, err = store.inner.NewSession(email, session)
+	}
+	if err == nil {
+		store.created[nonce] = time.Now()
+	}
+	return nonce, err
+}
+
+func (store *faultStore) ConsumeNonce(nonce string, email string) error {
+	_, err := store.ConsumeSession(nonce, email)
+	return err
+}
+
+func (store *faultStore) ConsumeSession(nonce string, email string) (*portier.Session, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.storeFailing {
+		return nil, errInjectedStore
+	}
+
+	created := store.created[nonce]
+	delete(store.created, nonce)
+	if !store.expiredAt.IsZero() && !created.After(store.expiredAt) {
+		store.inner.ConsumeNonce(nonce, email)
+		return nil, &portier.InvalidNonce{}
+	}
+	return store.inner.ConsumeSession(nonce, email)
+}
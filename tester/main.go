@@ -2,7 +2,12 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"strings"
 
@@ -12,55 +17,178 @@ import (
 const verifyEndpoint = "http://imaginary-client.test/fake-verify-route"
 
 func main() {
-	if len(os.Args) != 2 {
-		log.Fatal("Broker required")
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run implements main, returning errors instead of exiting, so deferred
+// functions such as saving the store still run.
+func run() (err error) {
+	jsonMode := flag.Bool("json", false, "read and write newline-delimited JSON arrays instead of tab-separated lines")
+	responseMode := flag.String("response-mode", "", "response mode to request (form_post or fragment)")
+	leeway := flag.Duration("leeway", 0, "time offset to allow when validating JWT claims")
+	storeSpec := flag.String("store", "memory", "store to use: memory, memory:<path> to load nonces from and save them to a file, or redis://[[user]:password@]host[:port][/database] to share nonces between processes")
+	serve := flag.String("serve", "", "instead of the line protocol, run an HTTP server on this address")
+	publicURL := flag.String("public-url", "", "public origin of the HTTP server (default http://<serve address>)")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		return errors.New("Broker required")
+	}
+
+	memoryStore, saveStore, err := newStore(*storeSpec)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if saveErr := saveStore(); err == nil {
+			err = saveErr
+		}
+	}()
+	store := newFaultStore(memoryStore)
+
+	redirectURI := verifyEndpoint
+	if *serve != "" {
+		if *publicURL == "" {
+			*publicURL = "http://" + *serve
+		}
+		redirectURI = strings.TrimSuffix(*publicURL, "/") + "/verify"
 	}
 
 	client, err := portier.NewClient(&portier.Config{
-		Broker:      os.Args[1],
-		RedirectURI: verifyEndpoint,
+		Store:        store,
+		Broker:       flag.Arg(0),
+		RedirectURI:  redirectURI,
+		ResponseMode: *responseMode,
+		Leeway:       *leeway,
 	})
 	if err != nil {
-		log.Fatal("portier.NewClient error:", err)
+		return fmt.Errorf("portier.NewClient error: %w", err)
 	}
 
-	writeLine := func(cmd ...string) {
-		_, err := os.Stdout.WriteString(strings.Join(cmd, "\t") + "\n")
-		if err != nil {
-			log.Fatal("stdout error", err)
+	if *serve != "" {
+		return runServer(*serve, client)
+	}
+
+	// readLine and writeLine implement the protocol framing. In text mode,
+	// fields are tab-separated. In JSON mode, each line is an array of strings.
+	readLine := func(line string) ([]string, error) {
+		return strings.Split(line, "\t"), nil
+	}
+	writeLine := func(cmd ...string) error {
+		if _, err := os.Stdout.WriteString(strings.Join(cmd, "\t") + "\n"); err != nil {
+			return fmt.Errorf("stdout error: %w", err)
+		}
+		return nil
+	}
+	if *jsonMode {
+		readLine = func(line string) ([]string, error) {
+			var cmd []string
+			if err := json.Unmarshal([]byte(line), &cmd); err != nil {
+				return nil, fmt.Errorf("invalid JSON command: %w", err)
+			}
+			return cmd, nil
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		writeLine = func(cmd ...string) error {
+			if err := encoder.Encode(cmd); err != nil {
+				return fmt.Errorf("stdout error: %w", err)
+			}
+			return nil
 		}
 	}
 
 	stdin := bufio.NewScanner(os.Stdin)
 	for stdin.Scan() {
-		cmd := strings.Split(stdin.Text(), "\t")
+		cmd, err := readLine(stdin.Text())
+		if err != nil {
+			return err
+		}
+		if len(cmd) == 0 {
+			return errors.New("empty command")
+		}
 		switch cmd[0] {
 		case "echo":
-			writeLine("ok", cmd[1])
+			err = writeLine("ok", cmd[1])
 		case "auth":
 			var url string
+			var authErr error
 			if len(cmd) >= 3 {
-				url, err = client.StartAuth(cmd[1], portier.WithState(cmd[2]))
+				url, authErr = client.StartAuth(cmd[1], portier.WithState(cmd[2]))
 			} else {
-				url, err = client.StartAuth(cmd[1])
+				url, authErr = client.StartAuth(cmd[1])
 			}
-			if err != nil {
-				writeLine("err", err.Error())
+			if authErr != nil {
+				err = writeLine("err", authErr.Error())
 			} else {
-				writeLine("ok", url)
+				err = writeLine("ok", url)
 			}
 		case "verify":
-			email, err := client.Verify(cmd[1])
-			if err != nil {
-				writeLine("err", err.Error())
+			email, verifyErr := client.Verify(cmd[1])
+			if verifyErr != nil {
+				err = writeLine("err", verifyErr.Error())
 			} else {
-				writeLine("ok", email)
+				err = writeLine("ok", email)
+			}
+		case "fault":
+			if !store.inject(cmd[1:]) {
+				return fmt.Errorf("invalid fault: %v", cmd)
 			}
+			err = writeLine("ok", cmd[1])
 		default:
-			log.Fatal("invalid command:", cmd)
+			return fmt.Errorf("invalid command: %v", cmd)
+		}
+		if err != nil {
+			return err
 		}
 	}
-	if err := stdin.Err(); err != nil {
-		log.Fatal(err)
+	return stdin.Err()
+}
+
+// newStore creates the store selected with the -store flag, and returns a
+// function that must be called before exit.
+func newStore(spec string) (portier.MemoryStore, func() error, error) {
+	store := portier.NewMemoryStore(&http.Client{Timeout: portier.DefaultHTTPTimeout})
+
+	if strings.HasPrefix(spec, "redis://") {
+		redisStore, err := newRedisStore(store, spec)
+		if err != nil {
+			return nil, nil, err
+		}
+		return redisStore, func() error { return nil }, nil
+	}
+
+	kind, path := spec, ""
+	if i := strings.IndexByte(spec, ':'); i != -1 {
+		kind, path = spec[:i], spec[i+1:]
+	}
+	if kind != "memory" {
+		return nil, nil, fmt.Errorf("unsupported store: %s", spec)
+	}
+	if path == "" {
+		return store, func() error { return nil }, nil
 	}
+
+	if f, err := os.Open(path); err == nil {
+		err = store.LoadNonces(f)
+		f.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not load nonces: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("could not load nonces: %w", err)
+	}
+
+	return store, func() error {
+		f, err := os.Create(path)
+		if err != nil {
+			return fmt.Errorf("could not save nonces: %w", err)
+		}
+		defer f.Close()
+		if err := store.SaveNonces(f); err != nil {
+			return fmt.Errorf("could not save nonces: %w", err)
+		}
+		return nil
+	}, nil
 }
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/portier/portier-go"
+)
+
+// redisTimeout limits each round-trip to the Redis server.
+const redisTimeout = 5 * time.Second
+
+// errRedisNil is returned by redisConn.do for a nil reply.
+var errRedisNil = errors.New("redis: nil reply")
+
+// redisStore keeps nonces and token IDs in Redis, so multiple tester processes
+// pointed at the same server share them. Documents are still cached by the
+// wrapped in-memory store of each process.
+//
+// Nonces are consumed with GETDEL, which requires Redis 6.2 or newer.
+type redisStore struct {
+	portier.MemoryStore
+	conn *redisConn
+}
+
+func newRedisStore(memoryStore portier.MemoryStore, rawURL string) (*redisStore, error) {
+	conn, err := dialRedis(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return &redisStore{memoryStore, conn}, nil
+}
+
+func nonceKey(nonce string, email string) string {
+	return "portier:nonce:" + nonce + ":" + email
+}
+
+func (store *redisStore) NewNonce(email string) (string, error) {
+	return store.NewSession(email, nil)
+}
+
+func (store *redisStore) NewSession(email string, session *portier.Session) (string, error) {
+	return store.NewSessionTTL(email, session, portier.DefaultNonceTTL)
+}
+
+func (store *redisStore) NewSessionTTL(email string, session *portier.Session, ttl time.Duration) (string, error) {
+	if session == nil {
+		session = &portier.Session{}
+	}
+	if ttl <= 0 {
+		ttl = portier.DefaultNonceTTL
+	}
+	value, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := portier.GenerateNonceFrom(rand.Reader)
+	if err != nil {
+		return "", fmt.Errorf("nonce generator error: %w", err)
+	}
+	ms := strconv.FormatInt(ttl.Milliseconds(), 10)
+	if _, err := store.conn.do("SET", nonceKey(nonce, email), string(value), "PX", ms); err != nil {
+		return "", err
+	}
+	return nonce, nil
+}
+
+func (store *redisStore) ConsumeNonce(nonce string, email string) error {
+	_, err := store.ConsumeSession(nonce, email)
+	return err
+}
+
+func (store *redisStore) ConsumeSession(nonce string, email string) (*portier.Session, error) {
+	value, err := store.conn.do("GETDEL", nonceKey(nonce, email))
+	if err == errRedisNil {
+		return nil, &portier.InvalidNonce{}
+	}
+	if err != nil {
+		return nil, err
+	}
+	session := &portier.Session{}
+	if err := json.Unmarshal([]byte(value), session); err != nil {
+		return nil, fmt.Errorf("invalid session in redis: %w", err)
+	}
+	return session, nil
+}
+
+func (store *redisStore) ConsumeTokenID(id string, expires time.Time) (bool, error) {
+	ms := time.Until(expires).Milliseconds()
+	if ms <= 0 {
+		return true, nil
+	}
+	_, err := store.conn.do("SET", "portier:jti:"+id, "1", "NX", "PX", strconv.FormatInt(ms, 10))
+	if err == errRedisNil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (store *redisStore) SaveNonces(w io.Writer) error {
+	return errors.New("redis store does not support saving nonces")
+}
+
+func (store *redisStore) LoadNonces(r io.Reader) error {
+	return errors.New("redis store does not support loading nonces")
+}
+
+// redisConn is a minimal client for the Redis protocol (RESP). It uses a
+// single connection, which is redialed after an error.
+type redisConn struct {
+	addr     string
+	auth     []string
+	database string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// dialRedis connects to a server given a URL in the form
+// redis://[[user]:password@]host[:port][/database].
+func dialRedis(rawURL string) (*redisConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis URL: %w", err)
+	}
+	if u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("invalid redis URL: %s", rawURL)
+	}
+	client := &redisConn{addr: u.Host}
+	if u.Port() == "" {
+		client.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if password, ok := u.User.Password(); ok {
+		if user := u.User.Username(); user != "" {
+			client.auth = []string{user, password}
+		} else {
+			client.auth = []string{password}
+		}
+	}
+	client.database = strings.TrimPrefix(u.Path, "/")
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if err := client.connect(); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// connect dials the server, and authenticates and selects the database if
+// configured. The caller must hold the lock.
+func (client *redisConn) connect() error {
+	conn, err := net.DialTimeout("tcp", client.addr, redisTimeout)
+	if err != nil {
+		return fmt.Errorf("redis: %w", err)
+	}
+	client.conn = conn
+	client.reader = bufio.NewReader(conn)
+
+	if len(client.auth) != 0 {
+		if _, err := client.roundTrip(append([]string{"AUTH"}, client.auth...)); err != nil {
+			client.close()
+			return err
+		}
+	}
+	if client.database != "" {
+		if _, err := client.roundTrip([]string{"SELECT", client.database}); err != nil {
+			client.close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (client *redisConn) close() {
+	client.conn.Close()
+	client.conn = nil
+	client.reader = nil
+}
+
+// do sends a command, and returns the reply as a string. Nil replies result in
+// errRedisNil, and error replies in an error with the server message.
+func (client *redisConn) do(args ...string) (string, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if client.conn == nil {
+		if err := client.connect(); err != nil {
+			return "", err
+		}
+	}
+	reply, err := client.roundTrip(args)
+	var replyErr redisError
+	if err != nil && err != errRedisNil && !errors.As(err, &replyErr) {
+		client.close()
+	}
+	return reply, err
+}
+
+// roundTrip writes a command and reads the reply. The caller must hold the
+// lock.
+func (client *redisConn) roundTrip(args []string) (string, error) {
+	var cmd strings.Builder
+	fmt.Fprintf(&cmd, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&cmd, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	client.conn.SetDeadline(time.Now().Add(redisTimeout))
+	if _, err := io.WriteString(client.conn, cmd.String()); err != nil {
+		return "", fmt.Errorf("redis: %w", err)
+	}
+
+	line, err := client.readLine()
+	if err != nil {
+		return "", err
+	}
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", redisError(line[1:])
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", fmt.Errorf("redis: invalid reply: %q", line)
+		}
+		if size < 0 {
+			return "", errRedisNil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(client.reader, data); err != nil {
+			return "", fmt.Errorf("redis: %w", err)
+		}
+		return string(data[:size]), nil
+	default:
+		return "", fmt.Errorf("redis: unexpected reply: %q", line)
+	}
+}
+
+func (client *redisConn) readLine() (string, error) {
+	line, err := client.reader.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("redis: %w", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return "", errors.New("redis: empty reply")
+	}
+	return line, nil
+}
+
+// redisError is an error reply from the server.
+type redisError string
+
+func (err redisError) Error() string {
+	return "redis: " + string(err)
+}
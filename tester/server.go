@@ -0,0 +1,67 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+
+	"github.com/portier/portier-go"
+	"github.com/portier/portier-go/portierhttp"
+)
+
+// serverPage is rendered for every page of the test server. The elements have
+// stable IDs, so browser-driven test suites can interact with them.
+var serverPage = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Portier test client</title></head>
+<body>
+{{if .Email}}<p>Verified: <span id="email">{{.Email}}</span></p>{{end}}
+{{if .Error}}<p>Error: <span id="error">{{.Error}}</span></p>{{end}}
+<form id="login" method="post" action="/login">
+<input type="email" id="email-input" name="email" required>
+<button type="submit" id="submit">Log in</button>
+</form>
+</body>
+</html>
+`))
+
+type serverPageData struct {
+	Email string
+	Error string
+}
+
+// runServer runs an HTTP server implementing the login form, the redirect to
+// the broker, and the verify callback, for end-to-end testing.
+func runServer(addr string, client portier.Client) error {
+	render := func(w http.ResponseWriter, status int, data *serverPageData) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		serverPage.Execute(w, data)
+	}
+	renderError := func(w http.ResponseWriter, r *http.Request, err error) {
+		render(w, http.StatusBadRequest, &serverPageData{Error: err.Error()})
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		render(w, http.StatusOK, &serverPageData{})
+	})
+	mux.Handle("/login", &portierhttp.LoginHandler{
+		Client: client,
+		Error:  renderError,
+	})
+	mux.Handle("/verify", portier.FragmentHandler(&portierhttp.CallbackHandler{
+		Client: client,
+		Success: func(w http.ResponseWriter, r *http.Request, result *portier.VerifyResult) {
+			render(w, http.StatusOK, &serverPageData{Email: result.Email})
+		},
+		Error: renderError,
+	}))
+
+	log.Printf("listening on %s", addr)
+	return http.ListenAndServe(addr, mux)
+}
@@ -1,11 +1,18 @@
 package portier
 
 import (
+	"crypto"
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/url"
+	"strings"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
 )
 
 // discoveryDoc is the model used for JSON decoding of the OpenID discovery
@@ -21,12 +28,117 @@ type discoveryDoc struct {
 // This is the default implementation used by a Store.NewNonce to generate
 // nonces (numbers used once). This function panics if the RNG fails.
 func GenerateNonce() string {
-	buf := make([]byte, 16)
-	if _, err := rand.Read(buf); err != nil {
+	nonce, err := GenerateNonceFrom(rand.Reader)
+	if err != nil {
 		log.Fatal("nonce generator error:", err)
 	}
 
-	return hex.EncodeToString(buf)
+	return nonce
+}
+
+// GenerateNonceFrom is like GenerateNonce, but reads random data from the
+// given source, and returns an error if reading fails.
+//
+// This allows tests to produce deterministic nonces, or deployments to route
+// nonce generation through an approved random bit generator.
+func GenerateNonceFrom(random io.Reader) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := io.ReadFull(random, buf); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+// MinNonceSize is the minimum number of random bytes in a nonce, as accepted by
+// HexNonceGenerator and Base64NonceGenerator. UUIDNonceGenerator is the only
+// exception; see its documentation.
+const MinNonceSize = 16
+
+// NonceGenerator generates a nonce using random data from the given source.
+// GenerateNonceFrom is the default implementation. Nonces must be URL safe.
+type NonceGenerator func(random io.Reader) (string, error)
+
+// HexNonceGenerator returns a NonceGenerator for hex encoded nonces of size
+// random bytes. GenerateNonceFrom is equivalent to HexNonceGenerator(16). This
+// function panics if size is less than MinNonceSize.
+func HexNonceGenerator(size int) NonceGenerator {
+	checkNonceSize(size)
+	return func(random io.Reader) (string, error) {
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(random, buf); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(buf), nil
+	}
+}
+
+// Base64NonceGenerator returns a NonceGenerator for unpadded base64url encoded
+// nonces of size random bytes. This function panics if size is less than
+// MinNonceSize.
+func Base64NonceGenerator(size int) NonceGenerator {
+	checkNonceSize(size)
+	return func(random io.Reader) (string, error) {
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(random, buf); err != nil {
+			return "", err
+		}
+		return base64.RawURLEncoding.EncodeToString(buf), nil
+	}
+}
+
+// checkNonceSize panics if size is too small for nonces to be unguessable.
+func checkNonceSize(size int) {
+	if size < MinNonceSize {
+		panic(fmt.Sprintf("portier: nonce size must be at least %d bytes, got %d", MinNonceSize, size))
+	}
+}
+
+// UUIDNonceGenerator is a NonceGenerator for nonces formatted as random
+// (version 4) UUIDs, for infrastructure that only accepts identifiers in UUID
+// format.
+//
+// A UUID has room for 16 bytes, but 6 bits are fixed to mark the version and
+// variant, leaving 122 random bits. This is below MinNonceSize, and is allowed
+// as the only exception because the format can't hold more. A nonce only has
+// to be unguessable for the few minutes a login is in flight, and 122 bits are
+// still far beyond what can be guessed online in that time. Deployments
+// without a need for the UUID format should use the default generator or
+// HexNonceGenerator instead.
+func UUIDNonceGenerator(random io.Reader) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := io.ReadFull(random, buf); err != nil {
+		return "", err
+	}
+	buf[6] = (buf[6] & 0x0f) | 0x40
+	buf[8] = (buf[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", buf[0:4], buf[4:6], buf[6:8], buf[8:10], buf[10:16]), nil
+}
+
+// KeyThumbprint returns the RFC 7638 SHA-256 thumbprint of a key, in
+// unpadded base64url encoding. This is the format used in Config.PinnedKeys.
+func KeyThumbprint(key jwk.Key) (string, error) {
+	thumbprint, err := key.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(thumbprint), nil
+}
+
+// pinKeys returns a new key set containing only the keys from keySet with a
+// thumbprint in pins. The input key set may be shared, and is not modified.
+func pinKeys(keySet jwk.Set, pins map[string]bool) jwk.Set {
+	pinned := jwk.NewSet()
+	for i := 0; i < keySet.Len(); i++ {
+		key, _ := keySet.Key(i)
+		thumbprint, err := KeyThumbprint(key)
+		if err == nil && pins[thumbprint] {
+			pinned.AddKey(key)
+		}
+	}
+
+	return pinned
 }
 
 // isOrigin checks whether a URL is a valid origin.
@@ -41,6 +153,16 @@ func isOrigin(url *url.URL) bool {
 		url.RawFragment == ""
 }
 
+// isLoopback checks whether a URL refers to a loopback host.
+func isLoopback(url *url.URL) bool {
+	host := url.Hostname()
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
 // originOf returns the origin of an absolute URL.
 func originOf(url *url.URL) string {
 	if url.Opaque != "" {
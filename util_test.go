@@ -0,0 +1,50 @@
+package portier
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestNonceGeneratorSize(t *testing.T) {
+	generators := map[string]func(size int) NonceGenerator{
+		"hex":    HexNonceGenerator,
+		"base64": Base64NonceGenerator,
+	}
+	for name, newGenerator := range generators {
+		for _, size := range []int{0, MinNonceSize - 1} {
+			func() {
+				defer func() {
+					if recover() == nil {
+						t.Errorf("%s: size %d was accepted", name, size)
+					}
+				}()
+				newGenerator(size)
+			}()
+		}
+
+		nonce, err := newGenerator(MinNonceSize)(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nonce) < MinNonceSize {
+			t.Errorf("%s: nonce too short: %s", name, nonce)
+		}
+	}
+}
+
+func TestUUIDNonceGenerator(t *testing.T) {
+	random := bytes.NewReader(bytes.Repeat([]byte{0xff}, 16))
+	nonce, err := UUIDNonceGenerator(random)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// All bits set, except those fixed for version 4 and the RFC 4122 variant.
+	if want := "ffffffff-ffff-4fff-bfff-ffffffffffff"; nonce != want {
+		t.Errorf("got %s, want %s", nonce, want)
+	}
+
+	if _, err := UUIDNonceGenerator(bytes.NewReader(nil)); err == nil {
+		t.Error("short read was accepted")
+	}
+}